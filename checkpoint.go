@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Checkpoint allows for marshling of the checkpoint of a run, which lists the URLs fully processed so far with their log.
+type Checkpoint struct {
+	XMLName xml.Name           `xml:"checkpoint"`
+	Updated time.Time          `xml:"updated,attr"`
+	Entries []*CheckpointEntry `xml:"url"`
+}
+
+// CheckpointEntry allows for marshling of a URL fully processed by a run, either stored or failed.
+type CheckpointEntry struct {
+	Position   int         `xml:"position,attr"` // Position of the URL in the configuration file.
+	Link       string      `xml:"link,attr"`
+	Fetch      *Fetch      `xml:"fetch"`
+	FetchError *FetchError `xml:"error"`
+}
+
+// Checkpointer collects the fetch logs and errors of a run, and periodically saves those of the URLs fully processed
+// to the checkpoint of the run, so that a run restarted with the same FETCH_ID, offset and limit skips them.
+type Checkpointer struct {
+	sync.Mutex                          // Protects the checkpoint.
+	store      Storage                  // Stores the storage of the checkpoint.
+	path       string                   // Stores the path of the checkpoint.
+	interval   time.Duration            // Stores the interval between two saves of the checkpoint.
+	checkpoint *Checkpoint              // Stores the URLs processed by the previous runs which are resumed, and by this run.
+	previous   map[int]*CheckpointEntry // Stores the URLs processed by the previous runs, by position.
+	changed    bool                     // Stores whether the checkpoint changed since it was saved.
+	unfinished []*FetchError            // Stores the errors of the URLs of this run which are not fully processed, e.g. interrupted.
+	stop       chan struct{}            // Closed to stop collecting.
+	done       chan struct{}            // Closed once the collection is stopped.
+	started    bool                     // Stores whether the collection was started.
+}
+
+// CheckpointFromStorage returns the Checkpointer of the run, resumed from its checkpoint in the storage, if any.
+func CheckpointFromStorage(store Storage) (*Checkpointer, error) {
+	seconds := intFromEnvVar("CHECKPOINT_INTERVAL", 30)
+	if seconds <= 0 {
+		return nil, fmt.Errorf("CHECKPOINT_INTERVAL must be a positive number of seconds, not %d", seconds)
+	}
+	checkpointer := &Checkpointer{store: store, path: checkpointPath(), interval: time.Duration(seconds) * time.Second, checkpoint: &Checkpoint{},
+		previous: make(map[int]*CheckpointEntry), stop: make(chan struct{}), done: make(chan struct{})}
+	exists, err := store.Exists(checkpointer.path)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return checkpointer, nil
+	}
+	data, err := store.Get(checkpointer.path)
+	if err != nil {
+		return nil, err
+	}
+	previous := Checkpoint{}
+	if err = xml.Unmarshal(data, &previous); err != nil {
+		return nil, fmt.Errorf("could not parse the checkpoint %s: %s", checkpointer.path, err)
+	}
+	for _, entry := range previous.Entries {
+		checkpointer.previous[entry.Position] = entry
+	}
+	log.Notice("Resuming the run from its checkpoint of %s, with %d URLs processed.", previous.Updated, len(checkpointer.previous))
+	return checkpointer, nil
+}
+
+// Resume returns whether the URL was processed by a previous run, in which case it is not fetched again and its log is kept.
+// The URLs whose link changed since are fetched again, and the previous log of the URLs which are not resumed is dropped.
+func (checkpointer *Checkpointer) Resume(urlInfo *URLInfo) bool {
+	checkpointer.Lock()
+	defer checkpointer.Unlock()
+	entry, processed := checkpointer.previous[urlInfo.position]
+	if !processed || entry.Link != urlInfo.Link {
+		return false
+	}
+	checkpointer.checkpoint.Entries = append(checkpointer.checkpoint.Entries, entry)
+	return true
+}
+
+// Start starts collecting the fetch logs and errors from the channels in the go routine started by spawn, e.g. which
+// turns its panic into the fatal error of the run.
+func (checkpointer *Checkpointer) Start(logChan <-chan *Fetch, errChan <-chan *FetchError, spawn func(func())) {
+	checkpointer.Lock()
+	checkpointer.started = true
+	checkpointer.Unlock()
+	spawn(func() { checkpointer.collect(logChan, errChan) })
+}
+
+// collect collects the fetch logs and errors from the channels, and saves the checkpoint at every interval, until both channels
+// are closed or the collection is stopped.
+func (checkpointer *Checkpointer) collect(logChan <-chan *Fetch, errChan <-chan *FetchError) {
+	defer close(checkpointer.done)
+	ticker := time.NewTicker(checkpointer.interval)
+	defer ticker.Stop()
+	for logChan != nil || errChan != nil {
+		select {
+		case fetch, open := <-logChan:
+			if !open {
+				logChan = nil
+				continue
+			}
+			checkpointer.add(&CheckpointEntry{Position: fetch.urlInfo.position, Link: fetch.urlInfo.Link, Fetch: fetch})
+		case fetchErr, open := <-errChan:
+			if !open {
+				errChan = nil
+				continue
+			}
+			checkpointer.add(&CheckpointEntry{Position: fetchErr.urlInfo.position, Link: fetchErr.urlInfo.Link, FetchError: fetchErr})
+		case <-ticker.C:
+			if err := checkpointer.Save(); err != nil {
+				log.Error("Could not save the checkpoint %s: %s", checkpointer.path, err)
+			}
+		case <-checkpointer.stop:
+			// The logs and the errors already sent are collected, without waiting for the pending fetches.
+			for fetch, ok := receiveFetch(logChan); ok; fetch, ok = receiveFetch(logChan) {
+				checkpointer.add(&CheckpointEntry{Position: fetch.urlInfo.position, Link: fetch.urlInfo.Link, Fetch: fetch})
+			}
+			for fetchErr, ok := receiveFetchError(errChan); ok; fetchErr, ok = receiveFetchError(errChan) {
+				checkpointer.add(&CheckpointEntry{Position: fetchErr.urlInfo.position, Link: fetchErr.urlInfo.Link, FetchError: fetchErr})
+			}
+			return
+		}
+	}
+}
+
+// Stop stops the collection and waits for it to return. It returns at once if the collection was never started.
+func (checkpointer *Checkpointer) Stop() {
+	close(checkpointer.stop)
+	checkpointer.Lock()
+	started := checkpointer.started
+	checkpointer.Unlock()
+	if started {
+		<-checkpointer.done
+	}
+}
+
+// Results returns the fetch logs and errors of the URLs processed by the previous runs and by this run, in order of processing.
+func (checkpointer *Checkpointer) Results() ([]*Fetch, []*FetchError) {
+	checkpointer.Lock()
+	defer checkpointer.Unlock()
+	var fetches []*Fetch
+	var fetchErrors []*FetchError
+	for _, entry := range checkpointer.checkpoint.Entries {
+		if entry.Fetch != nil {
+			fetches = append(fetches, entry.Fetch)
+		}
+		if entry.FetchError != nil {
+			fetchErrors = append(fetchErrors, entry.FetchError)
+		}
+	}
+	return fetches, append(fetchErrors, checkpointer.unfinished...)
+}
+
+// Save writes the checkpoint to the storage if it changed since it was last saved.
+func (checkpointer *Checkpointer) Save() error {
+	checkpointer.Lock()
+	defer checkpointer.Unlock()
+	if !checkpointer.changed {
+		return nil
+	}
+	checkpointer.checkpoint.Updated = time.Now().UTC()
+	content, _ := xml.MarshalIndent(checkpointer.checkpoint, "", "\t")
+	if err := checkpointer.store.Put(checkpointer.path, []byte(xml.Header+string(content)), "application/xml"); err != nil {
+		return err
+	}
+	checkpointer.changed = false
+	return nil
+}
+
+// Delete deletes the checkpoint from the storage, once the run is complete.
+func (checkpointer *Checkpointer) Delete() error {
+	return checkpointer.store.Delete(checkpointer.path)
+}
+
+// add adds the entry of a URL processed by this run. The URLs stopped with the run are not fully processed,
+// so they are logged but not checkpointed.
+func (checkpointer *Checkpointer) add(entry *CheckpointEntry) {
+	checkpointer.Lock()
+	defer checkpointer.Unlock()
+	if entry.FetchError != nil && entry.FetchError.unfinished() {
+		checkpointer.unfinished = append(checkpointer.unfinished, entry.FetchError)
+		return
+	}
+	checkpointer.checkpoint.Entries = append(checkpointer.checkpoint.Entries, entry)
+	checkpointer.changed = true
+}
+
+// unfinished returns whether the error is that of a URL stopped with the run, i.e. interrupted or cut off, which is fetched
+// again by the resumed run.
+func (fetchErr *FetchError) unfinished() bool {
+	return fetchErr.Reason == "interrupted" || fetchErr.Reason == "cutoff"
+}
+
+// checkpointPath returns the path of the checkpoint of the run, from its FETCH_ID, offset and limit.
+func checkpointPath() string {
+	return fmt.Sprintf("%s/checkpoint/%s_%s_%s.xml", storageRoot(), os.Getenv("FETCH_ID"), os.Getenv("FETCH_OFFSET"), os.Getenv("FETCH_LIMIT"))
+}
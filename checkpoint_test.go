@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"os"
+	"testing"
+)
+
+// TestCheckpointer tests the collection, the saving and the resuming of the checkpoint of a run.
+func TestCheckpointer(t *testing.T) {
+	Convey("The checkpoint tests, ", t, func() {
+		store := NewMemoryStorage()
+		urls := []*URLInfo{{Link: "http://example.com/first", position: 0}, {Link: "http://example.com/second", position: 1},
+			{Link: "http://example.com/third", position: 2}}
+
+		checkpointer, err := CheckpointFromStorage(store)
+		So(err, ShouldBeNil)
+		logChan, errChan := make(chan *Fetch, 3), make(chan *FetchError, 3)
+		checkpointer.Start(logChan, errChan, func(routine func()) { go routine() })
+		logChan <- &Fetch{FinalLink: urls[0].Link, urlInfo: urls[0]}
+		errChan <- &FetchError{Original: urls[1].Link, Reason: "request", urlInfo: urls[1]}
+		errChan <- &FetchError{Original: urls[2].Link, Reason: "interrupted", urlInfo: urls[2]}
+		checkpointer.Stop()
+
+		fetches, fetchErrors := checkpointer.Results()
+		So(len(fetches), ShouldEqual, 1)
+		So(len(fetchErrors), ShouldEqual, 2)
+		So(checkpointer.Save(), ShouldBeNil)
+
+		Convey("The URLs fully processed are resumed, unless their link changed", func() {
+			resumed, err := CheckpointFromStorage(store)
+			So(err, ShouldBeNil)
+			So(resumed.Resume(urls[0]), ShouldBeTrue)
+			So(resumed.Resume(&URLInfo{Link: "http://example.com/changed", position: 1}), ShouldBeFalse)
+			// The interrupted URL is not fully processed.
+			So(resumed.Resume(urls[2]), ShouldBeFalse)
+			fetches, fetchErrors := resumed.Results()
+			So(len(fetches), ShouldEqual, 1)
+			So(fetches[0].FinalLink, ShouldEqual, urls[0].Link)
+			So(fetchErrors, ShouldBeEmpty)
+		})
+
+		Convey("A checkpointer which never started collecting stops at once", func() {
+			idle, err := CheckpointFromStorage(store)
+			So(err, ShouldBeNil)
+			idle.Stop()
+		})
+
+		Convey("A checkpoint interval which is not positive is rejected", func() {
+			os.Setenv("CHECKPOINT_INTERVAL", "0")
+			defer os.Unsetenv("CHECKPOINT_INTERVAL")
+			rejected, err := CheckpointFromStorage(store)
+			So(err, ShouldNotBeNil)
+			So(rejected, ShouldBeNil)
+		})
+
+		Convey("A storage error while looking for the checkpoint is returned without a checkpointer", func() {
+			failing, err := CheckpointFromStorage(&unavailableStorage{Storage: store})
+			So(err, ShouldNotBeNil)
+			So(failing, ShouldBeNil)
+		})
+
+		Convey("The checkpoint is deleted once the run is complete", func() {
+			So(checkpointer.Delete(), ShouldBeNil)
+			exists, _ := store.Exists(checkpointPath())
+			So(exists, ShouldBeFalse)
+		})
+	})
+}
+
+// unavailableStorage is a storage which cannot tell whether a path exists.
+type unavailableStorage struct {
+	Storage
+}
+
+// Exists on unavailableStorage always fails.
+func (store *unavailableStorage) Exists(path string) (bool, error) {
+	return false, fmt.Errorf("storage unavailable")
+}
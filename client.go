@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// ClientConfig stores the configuration of the HTTP client, read from the configuration file.
+// The attributes which are not set take their default value.
+type ClientConfig struct {
+	UserAgent           string          `xml:"userAgent,attr,omitempty"`           // User-Agent header of the requests.
+	ConnectTimeout      float64         `xml:"connectTimeout,attr,omitempty"`      // Timeout of the connection to a host, including the TLS handshake.
+	ReadTimeout         float64         `xml:"readTimeout,attr,omitempty"`         // Timeout of the response headers and of each read of the response body.
+	Timeout             float64         `xml:"timeout,attr,omitempty"`             // Timeout of a whole request, including redirects and reading the body.
+	Unit                string          `xml:"unit,attr,omitempty"`                // Unit of the timeouts.
+	Proxy               string          `xml:"proxy,attr,omitempty"`               // URL of the HTTP proxy, else taken from the environment.
+	MaxIdleConns        int             `xml:"maxIdleConns,attr,omitempty"`        // Maximum number of idle connections, across all hosts.
+	MaxIdleConnsPerHost int             `xml:"maxIdleConnsPerHost,attr,omitempty"` // Maximum number of idle connections per host.
+	MaxConnsPerHost     int             `xml:"maxConnsPerHost,attr,omitempty"`     // Maximum number of connections per host, unlimited if zero.
+	Headers             []*ClientHeader `xml:"header"`                             // Extra request headers.
+
+	connectTimeout time.Duration // Stores the parsed connection timeout.
+	readTimeout    time.Duration // Stores the parsed read timeout.
+	timeout        time.Duration // Stores the parsed request timeout.
+	proxy          *url.URL      // Stores the parsed proxy URL.
+}
+
+// ClientHeader stores an extra request header, sent to all the hosts or to the provided host only.
+// Its value is expanded with the environment, e.g. `${API_KEY}`, so that secrets are not in the configuration file.
+type ClientHeader struct {
+	Host  string `xml:"host,attr,omitempty"`
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+// defaultClientConfig is the HTTP client configuration used when the configuration file does not define one. Its timeouts are in seconds.
+var defaultClientConfig = ClientConfig{UserAgent: robotsAgent, ConnectTimeout: 10, ReadTimeout: 30, Timeout: 120, Unit: "s", MaxIdleConns: 100, MaxIdleConnsPerHost: 4}
+
+// HTTPClient sends the requests of gofetch with the configured timeouts, proxy and headers.
+type HTTPClient struct {
+	client *http.Client  // Stores the underlying client.
+	config *ClientConfig // Stores the resolved configuration.
+}
+
+// timeoutBody is a response body whose reads time out if no data is received within the read timeout. The idle connections
+// of the pool are not read by the fetches, so they are only closed after the idle timeout.
+type timeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration      // Stores the read timeout.
+	cancel  context.CancelFunc // Stores the cancellation of the request, which aborts a read which timed out.
+}
+
+// resolve sets the default value of the unset attributes and parses the client configuration.
+func (config *ClientConfig) resolve() (err error) {
+	if config.UserAgent == "" {
+		config.UserAgent = defaultClientConfig.UserAgent
+	}
+	if config.Unit == "" {
+		config.Unit = defaultClientConfig.Unit
+	}
+	if config.MaxIdleConns == 0 {
+		config.MaxIdleConns = defaultClientConfig.MaxIdleConns
+	}
+	if config.MaxIdleConnsPerHost == 0 {
+		config.MaxIdleConnsPerHost = defaultClientConfig.MaxIdleConnsPerHost
+	}
+	if config.MaxIdleConns < 0 || config.MaxIdleConnsPerHost < 0 || config.MaxConnsPerHost < 0 {
+		return fmt.Errorf("the client connection limits must not be negative")
+	}
+	// The unset timeouts take the default value, whatever the unit.
+	timeouts := []struct {
+		value, deflt float64
+		parsed       *time.Duration
+	}{{config.ConnectTimeout, defaultClientConfig.ConnectTimeout, &config.connectTimeout},
+		{config.ReadTimeout, defaultClientConfig.ReadTimeout, &config.readTimeout},
+		{config.Timeout, defaultClientConfig.Timeout, &config.timeout}}
+	for _, timeout := range timeouts {
+		*timeout.parsed = time.Duration(timeout.deflt * float64(time.Second))
+		if timeout.value != 0 {
+			if *timeout.parsed, err = durationFromConfig(timeout.value, config.Unit); err != nil {
+				return err
+			}
+		}
+	}
+	if config.Proxy != "" {
+		if config.proxy, err = url.Parse(config.Proxy); err != nil {
+			return fmt.Errorf("invalid client proxy `%s`", config.Proxy)
+		}
+	}
+	for _, header := range config.Headers {
+		if header.Name == "" {
+			return fmt.Errorf("client header without a name")
+		}
+	}
+	return nil
+}
+
+// NewHTTPClient returns a new HTTPClient from the resolved client configuration.
+func NewHTTPClient(config *ClientConfig) *HTTPClient {
+	dialer := &net.Dialer{Timeout: config.connectTimeout, KeepAlive: 30 * time.Second}
+	// The response headers must be received within the read timeout, and the reads of the body are timed out by Do.
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   config.connectTimeout,
+		ResponseHeaderTimeout: config.readTimeout,
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       config.MaxConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	if config.proxy != nil {
+		transport.Proxy = http.ProxyURL(config.proxy)
+	}
+	httpClient := &HTTPClient{config: config}
+	httpClient.client = &http.Client{Transport: transport, Timeout: config.timeout, CheckRedirect: httpClient.checkRedirect}
+	return httpClient
+}
+
+// Do sends the request with the User-Agent and the extra headers, unless the request already has them.
+// The reads of the body of the response fail with a timeout error if no data is received within the read timeout.
+func (httpClient *HTTPClient) Do(req *http.Request) (*http.Response, error) {
+	httpClient.setHeaders(req)
+	if httpClient.config.readTimeout <= 0 {
+		return httpClient.client.Do(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err := httpClient.client.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &timeoutBody{ReadCloser: resp.Body, timeout: httpClient.config.readTimeout, cancel: cancel}
+	return resp, nil
+}
+
+// Get sends a GET request to the provided link.
+func (httpClient *HTTPClient) Get(link string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return nil, err
+	}
+	return httpClient.Do(req)
+}
+
+// setHeaders sets the User-Agent and the extra headers of the host of the request, unless the request already has them.
+func (httpClient *HTTPClient) setHeaders(req *http.Request) {
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", httpClient.config.UserAgent)
+	}
+	for _, header := range httpClient.config.Headers {
+		if (header.Host == "" || header.Host == req.URL.Host) && req.Header.Get(header.Name) == "" {
+			req.Header.Set(header.Name, os.ExpandEnv(header.Value))
+		}
+	}
+}
+
+// checkRedirect removes the extra headers of another host from a redirected request, so as to not leak them,
+// and sets those of the new host. The headers of the URL are also removed when it is redirected to another host
+// than its own. It stops after 10 redirects, as the default client does.
+func (httpClient *HTTPClient) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after 10 redirects")
+	}
+	for _, header := range httpClient.config.Headers {
+		if header.Host != "" && header.Host != req.URL.Host {
+			req.Header.Del(header.Name)
+		}
+	}
+	if urlHeaders, ok := req.Context().Value(urlHeadersKey{}).([]*Header); ok && req.URL.Host != via[0].URL.Host {
+		for _, header := range urlHeaders {
+			req.Header.Del(header.Name)
+		}
+	}
+	httpClient.setHeaders(req)
+	return nil
+}
+
+// Read reads from the body, failing with a timeout error if no data is received within the read timeout, in which case
+// the request is cancelled.
+func (body *timeoutBody) Read(data []byte) (int, error) {
+	timer := time.AfterFunc(body.timeout, body.cancel)
+	n, err := body.ReadCloser.Read(data)
+	if !timer.Stop() {
+		return n, os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+// Close closes the body and releases the context of the request.
+func (body *timeoutBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestHTTPClient tests the configuration of the HTTP client.
+func TestHTTPClient(t *testing.T) {
+	Convey("The HTTP client tests, ", t, func() {
+		var received http.Header
+		var remoteAddrs []string
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			remoteAddrs = append(remoteAddrs, r.RemoteAddr)
+			if r.URL.Path == "/slow" {
+				time.Sleep(100 * time.Millisecond)
+			}
+			if r.URL.Path == "/slow-body" {
+				w.Write([]byte("start"))
+				w.(http.Flusher).Flush()
+				time.Sleep(100 * time.Millisecond)
+			}
+			if location := r.URL.Query().Get("to"); location != "" {
+				http.Redirect(w, r, location, http.StatusFound)
+				return
+			}
+			received = r.Header
+		}))
+		defer origin.Close()
+		originURL, _ := url.Parse(origin.URL)
+
+		Convey("An empty client configuration takes the default values", func() {
+			config := &ClientConfig{}
+			So(config.resolve(), ShouldBeNil)
+			So(config.UserAgent, ShouldEqual, "gofetch")
+			So(config.connectTimeout, ShouldEqual, 10*time.Second)
+			So(config.readTimeout, ShouldEqual, 30*time.Second)
+			So(config.timeout, ShouldEqual, 2*time.Minute)
+		})
+
+		Convey("Invalid client configurations are rejected", func() {
+			So((&ClientConfig{Timeout: 1, Unit: "carrots"}).resolve(), ShouldNotBeNil)
+			So((&ClientConfig{MaxConnsPerHost: -1}).resolve(), ShouldNotBeNil)
+			So((&ClientConfig{Proxy: ":carrots"}).resolve(), ShouldNotBeNil)
+			So((&ClientConfig{Headers: []*ClientHeader{{Value: "carrots"}}}).resolve(), ShouldNotBeNil)
+		})
+
+		Convey("The requests have the User-Agent and the extra headers of their host", func() {
+			os.Setenv("GOFETCH_TEST_API_KEY", "secret")
+			defer os.Unsetenv("GOFETCH_TEST_API_KEY")
+			config := &ClientConfig{UserAgent: "gofetch-test", Headers: []*ClientHeader{
+				{Name: "Accept", Value: "application/xml"},
+				{Host: originURL.Host, Name: "X-Api-Key", Value: "${GOFETCH_TEST_API_KEY}"},
+				{Host: "other.example.com", Name: "X-Other-Key", Value: "other"}}}
+			So(config.resolve(), ShouldBeNil)
+			resp, err := NewHTTPClient(config).Get(origin.URL + "/feed")
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(received.Get("User-Agent"), ShouldEqual, "gofetch-test")
+			So(received.Get("Accept"), ShouldEqual, "application/xml")
+			So(received.Get("X-Api-Key"), ShouldEqual, "secret")
+			So(received.Get("X-Other-Key"), ShouldBeEmpty)
+		})
+
+		Convey("The headers of a URL are kept on the redirects to its host, but not to another host", func() {
+			var redirected http.Header
+			other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				redirected = r.Header
+			}))
+			defer other.Close()
+			config := &ClientConfig{}
+			So(config.resolve(), ShouldBeNil)
+			client := NewHTTPClient(config)
+			urlInfo := &URLInfo{Method: "GET", Headers: []*Header{{Name: "X-Url-Key", Value: "secret"}}}
+
+			req, err := urlInfo.NewRequest(context.Background(), origin.URL+"/redirect?to=/feed")
+			So(err, ShouldBeNil)
+			resp, err := client.Do(req)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(received.Get("X-Url-Key"), ShouldEqual, "secret")
+
+			req, err = urlInfo.NewRequest(context.Background(), origin.URL+"/redirect?to="+url.QueryEscape(other.URL+"/feed"))
+			So(err, ShouldBeNil)
+			resp, err = client.Do(req)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(redirected, ShouldNotBeNil)
+			So(redirected.Get("X-Url-Key"), ShouldBeEmpty)
+		})
+
+		Convey("A request without a response within the read timeout fails with a retryable error", func() {
+			config := &ClientConfig{ReadTimeout: 20, Unit: "ms"}
+			So(config.resolve(), ShouldBeNil)
+			_, err := NewHTTPClient(config).Get(origin.URL + "/slow")
+			So(err, ShouldNotBeNil)
+			policy := &RetryPolicy{}
+			So(policy.resolve(), ShouldBeNil)
+			So(policy.RetryableError(err), ShouldBeTrue)
+		})
+
+		Convey("A body without data within the read timeout fails with a retryable error", func() {
+			config := &ClientConfig{ReadTimeout: 20, Unit: "ms"}
+			So(config.resolve(), ShouldBeNil)
+			resp, err := NewHTTPClient(config).Get(origin.URL + "/slow-body")
+			So(err, ShouldBeNil)
+			_, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			So(err, ShouldNotBeNil)
+			policy := &RetryPolicy{}
+			So(policy.resolve(), ShouldBeNil)
+			So(policy.RetryableError(err), ShouldBeTrue)
+		})
+
+		Convey("An idle connection is reused after the read timeout", func() {
+			config := &ClientConfig{ReadTimeout: 20, Unit: "ms"}
+			So(config.resolve(), ShouldBeNil)
+			client := NewHTTPClient(config)
+			for i := 0; i < 2; i++ {
+				resp, err := client.Get(origin.URL + "/feed")
+				So(err, ShouldBeNil)
+				ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				time.Sleep(50 * time.Millisecond)
+			}
+			So(len(remoteAddrs), ShouldEqual, 2)
+			So(remoteAddrs[1], ShouldEqual, remoteAddrs[0])
+		})
+	})
+}
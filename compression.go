@@ -0,0 +1,61 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/Sparrho/gofetch/content"
+	"github.com/klauspost/compress/zstd"
+)
+
+// contentEncodings are the accepted encodings of the stored content, the first one being the default.
+// The stored content is read with the content package, which can be imported by the parsers.
+var contentEncodings = content.Encodings
+
+// Compression stores the encoding of the stored content, read from the configuration file.
+type Compression struct {
+	Encoding string `xml:"encoding,attr"`
+}
+
+// compressContent returns the body encoded with the provided encoding, spooled to disk if it is large.
+// The returned buffer is the body itself with the identity encoding.
+func compressContent(body *SpoolBuffer, encoding string) (*SpoolBuffer, error) {
+	if encoding == "identity" {
+		return body, nil
+	}
+	reader, err := body.Reader()
+	if err != nil {
+		return nil, err
+	}
+	compressed := body.spooler.NewBuffer()
+	var encoder io.WriteCloser
+	switch encoding {
+	case "gzip":
+		encoder = gzip.NewWriter(compressed)
+	case "zstd":
+		if encoder, err = zstd.NewWriter(compressed); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown content encoding `%s`", encoding)
+	}
+	if _, err = io.Copy(encoder, reader); err == nil {
+		err = encoder.Close()
+	}
+	if err != nil {
+		compressed.Close()
+		return nil, err
+	}
+	return compressed, nil
+}
+
+// validContentEncoding returns whether the provided content encoding is accepted.
+func validContentEncoding(encoding string) bool {
+	for _, accepted := range contentEncodings {
+		if encoding == accepted {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Sparrho/gofetch/content"
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+)
+
+// TestCompression tests the encoding of the stored content and its transparent decoding.
+func TestCompression(t *testing.T) {
+	Convey("The compression tests, ", t, func() {
+		store := NewMemoryStorage()
+		original := strings.Repeat("<item>gofetch</item>\n", 100)
+
+		for _, encoding := range contentEncodings {
+			for _, threshold := range []int64{1 << 20, 64} {
+				Convey(fmt.Sprintf("The content is stored with the %s encoding and read back as is, with a spool threshold of %d", encoding, threshold), func() {
+					body := (&Spooler{threshold: threshold}).NewBuffer()
+					body.Write([]byte(original))
+					defer body.Close()
+					So(storeContent(store, "/content", body, encoding, "text/xml"), ShouldBeNil)
+					metadata := `<metadata content_type="text/xml" encoding="` + encoding + `"></metadata>`
+					So(store.Put("/content.meta", []byte(metadata), "application/xml"), ShouldBeNil)
+
+					stored, _ := store.Get("/content")
+					So(store.ContentType("/content"), ShouldEqual, "text/xml")
+					if encoding == "identity" {
+						So(string(stored), ShouldEqual, original)
+						So(store.ContentEncoding("/content"), ShouldBeEmpty)
+					} else {
+						So(len(stored), ShouldBeLessThan, len(original)/5)
+						So(store.ContentEncoding("/content"), ShouldEqual, encoding)
+					}
+					decoded, err := content.Read(store, "/content")
+					So(err, ShouldBeNil)
+					So(string(decoded), ShouldEqual, original)
+				})
+			}
+		}
+
+		Convey("The encoding of the content stored by another writer is read back from its metadata", func() {
+			fetch := testHTTPFetch("http://example.com/feed", "rss")
+			So(storeContent(store, "/content", fetch.body, "gzip", "text/xml"), ShouldBeNil)
+			So(store.Put("/content.meta", []byte(`<metadata content_type="text/xml" encoding="gzip"></metadata>`), "application/xml"), ShouldBeNil)
+			stored, err := uploadContent(store, NewLocalLeases(), fetch, "/content", "zstd")
+			So(err, ShouldBeNil)
+			So(stored, ShouldBeFalse)
+			So(fetch.encoding, ShouldEqual, "gzip")
+		})
+
+		Convey("Unknown content encodings are rejected", func() {
+			So((&Config{Compression: &Compression{Encoding: "carrots"}}).Validate(), ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,84 @@
+// Package content reads the content stored by gofetch, transparently decoded as per its metadata, so that the parsers
+// do not depend on the encoding with which the content was stored.
+package content
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encodings are the accepted encodings of the stored content, the first one being the default.
+var Encodings = []string{"identity", "gzip", "zstd"}
+
+// Store details the part of a gofetch storage backend which is needed to read the stored content.
+type Store interface {
+	Get(path string) ([]byte, error)  // Returns the data stored at the given path.
+	Exists(path string) (bool, error) // Returns whether some data is stored at the given path.
+}
+
+// metadata allows for unmarshling of the encoding of the content from its metadata.
+type metadata struct {
+	Encoding string `xml:"encoding,attr"`
+}
+
+// Encoding returns the encoding of the content stored at the given path, from its metadata.
+// The content stored without metadata is not encoded.
+func Encoding(store Store, contentPath string) (string, error) {
+	data, err := store.Get(contentPath + ".meta")
+	if err != nil {
+		if exists, existsErr := store.Exists(contentPath + ".meta"); existsErr == nil && !exists {
+			return Encodings[0], nil
+		}
+		return "", err
+	}
+	meta := metadata{}
+	if err := xml.Unmarshal(data, &meta); err != nil {
+		return "", err
+	}
+	if meta.Encoding == "" {
+		return Encodings[0], nil
+	}
+	return meta.Encoding, nil
+}
+
+// Open returns a reader of the content stored at the given path, which is transparently decoded as per its metadata.
+func Open(store Store, contentPath string) (io.ReadCloser, error) {
+	encoding, err := Encoding(store, contentPath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := store.Get(contentPath)
+	if err != nil {
+		return nil, err
+	}
+	switch encoding {
+	case "identity":
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	case "gzip":
+		return gzip.NewReader(bytes.NewReader(data))
+	case "zstd":
+		decoder, err := zstd.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unknown content encoding `%s` of %s", encoding, contentPath)
+	}
+}
+
+// Read returns the content stored at the given path, decoded as per its metadata.
+func Read(store Store, contentPath string) ([]byte, error) {
+	reader, err := Open(store, contentPath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
@@ -0,0 +1,49 @@
+package content
+
+import (
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+// mapStore is a Store of the data of a map.
+type mapStore map[string][]byte
+
+// Get on mapStore returns the data of the path, or an error if there is none.
+func (store mapStore) Get(path string) ([]byte, error) {
+	data, exists := store[path]
+	if !exists {
+		return nil, fmt.Errorf("%s not found", path)
+	}
+	return data, nil
+}
+
+// Exists on mapStore returns whether there is some data at the path.
+func (store mapStore) Exists(path string) (bool, error) {
+	_, exists := store[path]
+	return exists, nil
+}
+
+// TestContent tests the decoding of the stored content as per its metadata.
+func TestContent(t *testing.T) {
+	Convey("The content tests, ", t, func() {
+		store := mapStore{}
+
+		Convey("The content without metadata is not encoded", func() {
+			store["/legacy"] = []byte("<item>gofetch</item>")
+			encoding, err := Encoding(store, "/legacy")
+			So(err, ShouldBeNil)
+			So(encoding, ShouldEqual, "identity")
+			data, err := Read(store, "/legacy")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "<item>gofetch</item>")
+		})
+
+		Convey("The content with an unknown encoding cannot be read", func() {
+			store["/content"] = []byte("<item>gofetch</item>")
+			store["/content.meta"] = []byte(`<metadata content_type="text/xml" encoding="carrots"></metadata>`)
+			_, err := Read(store, "/content")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"crypto/sha512"
 	"encoding/hex"
-	"io/ioutil"
+	"fmt"
+	"io"
 	"net/http"
-	"net/url"
+	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -13,59 +16,333 @@ import (
 
 // HTTPFetch stores a response from http.Get.
 type HTTPFetch struct {
-	urlInfo   *URLInfo       // Stores the UrlInfo which initiated the request.
-	response  *http.Response // Stores the response object.
-	body      []byte         // Stores the body so we can close the IO.
-	startTime time.Time      // Stores the start time of the fetch.
-	duration  time.Duration  // Stores the duration of the fetch in nanoseconds.
-	checksum  string         // Stores the sha384 checksum of the body.
+	urlInfo        *URLInfo       // Stores the UrlInfo which initiated the request.
+	cleanURL       string         // Stores the cleaned link of the UrlInfo, which was requested.
+	response       *http.Response // Stores the response object.
+	body           *SpoolBuffer   // Stores the body so we can close the IO, nil if the content is unchanged.
+	startTime      time.Time      // Stores the start time of the fetch.
+	duration       time.Duration  // Stores the duration of the fetch in nanoseconds.
+	checksum       string         // Stores the sha384 checksum of the body.
+	novel          bool           // Stores whether the checksum was novel, as determined from the canonical index.
+	indexEntry     string         // Stores the path of the entry of the fetch in the canonical index, once it is written.
+	entryName      string         // Stores the unique name of the entry of the fetch in the canonical index, unless it claims the first entry.
+	unchanged      bool           // Stores whether the content was not modified since the previous fetch (HTTP 304).
+	encoding       string         // Stores the encoding of the stored content.
+	attempts       int            // Stores the number of attempts of the fetch.
+	failedAttempts []*Attempt     // Stores the failed attempts of the fetch, as recorded in the output log.
+	storeFailures  []*Attempt     // Stores the failed storage attempts of the fetch, as recorded in the dead letters of the output log.
+	retryAt        time.Time      // Stores the earliest time of the next storage attempt, for retries.
 }
 
-// HTTPThrottler stores throttling information with the delay between requests and the latest fetch.
+// Validators stores the cache validators of a link, as returned by its latest fetch, for conditional fetching.
+type Validators struct {
+	ETag         string    // Stores the ETag response header.
+	LastModified string    // Stores the Last-Modified response header.
+	Checksum     string    // Stores the sha384 checksum of the content these validators refer to.
+	FetchTime    time.Time // Stores the start time of the fetch which returned these validators.
+}
+
+// HTTPThrottler stores throttling information with the delay between requests, the maximum number of concurrent
+// requests and the state of the requests to a given host. The state is only modified by the HostScheduler.
 type HTTPThrottler struct {
 	delay       time.Duration // Stores the delay between requests to a given host.
+	concurrency int           // Stores the maximum number of concurrent requests to a given host, unlimited if zero.
 	latestFetch time.Time     // Stores the time of the latest fetch.
+	inFlight    int           // Stores the number of requests in flight.
 }
 
-// Fetcher fetches a given URL. The result is put on the provided channel.
-func Fetcher(fetchChan <-chan *URLInfo, s3chan chan<- *HTTPFetch, errChan chan<- *FetchError, throttleMap map[string]*HTTPThrottler, wg *sync.WaitGroup) {
+// BodyError is the error of a response body which could not be read, either because it is truncated or because
+// it is larger than the maximum body size of the URL.
+type BodyError struct {
+	Reason string // Stores the reason of the error in the output log: "truncated" or "oversized".
+	Err    error  // Stores the underlying error.
+}
+
+// defaultMaxBodySize is the maximum body size, in bytes, when the configuration file does not define one.
+const defaultMaxBodySize = 50 << 20
+
+// recordedHeaders are the response headers recorded in the output log.
+var recordedHeaders = []string{"Content-Type", "Content-Length", "Content-Encoding", "ETag", "Last-Modified"}
+
+// unrecordedHeaders are the response headers which are not recorded in the content metadata.
+var unrecordedHeaders = map[string]bool{"Set-Cookie": true}
+
+// defaultContentType is the content type of the contents whose response has no Content-Type header.
+const defaultContentType = "application/octet-stream"
+
+// Fetcher fetches the jobs handed by the scheduler, one attempt at a time. The result is put on the provided channel.
+// The fetch is conditional if the link has cache validators in the storage from before the start of the run.
+// The URLs disallowed by the robots.txt file of their host are not fetched, unless their robots policy is to ignore it.
+// Failed attempts are given back to the scheduler as per the retry policy of the URL, and responses which still
+// have a non-success status are handled as per the status policy of the URL.
+// The attempts are cancelled with the context of the run, and the fetch of a URL is not retried past its deadline, if any.
+func Fetcher(ctx context.Context, client *HTTPClient, spooler *Spooler, store Storage, runStart time.Time, fetchDeadline time.Duration, scheduler *HostScheduler, robots *RobotsCache,
+	s3chan chan<- *HTTPFetch, errChan chan<- *FetchError, wg *sync.WaitGroup) {
 	for {
-		urlInfo, more := <-fetchChan
+		job, more := scheduler.Next()
 		if !more {
 			log.Info("No more URLs to process.")
 			return
 		}
-		start := time.Now()
-		cleanURL := strings.Replace(strings.TrimSpace(urlInfo.Link), " ", "+", -1)
-
-		// Check if this host needs throttling.
-		parsedURL, _ := url.Parse(cleanURL) // Note that we do not catch any error here since it will be caught on the GET
-		if throttle := throttleMap[parsedURL.Host]; throttle != nil {
-			time.Sleep(throttle.delay - time.Now().Sub(throttle.latestFetch))
-			throttle.latestFetch = time.Now() // Updating the latestFetch is sufficient since the map is for a ref.
+		urlInfo, cleanURL := job.urlInfo, job.cleanURL
+		if job.attempt == 1 && fetchDeadline > 0 {
+			job.deadline = time.Now().Add(fetchDeadline)
+		}
+
+		if job.attempt == 1 && urlInfo.Robots == "obey" && !robots.Allowed(ctx, job, scheduler) {
+			scheduler.Done(job)
+			errChan <- &FetchError{urlInfo: urlInfo, Cleaned: cleanURL, Original: urlInfo.Link, Reason: "robots", Message: "disallowed by robots.txt"}
+			log.Warning("Not fetching %s: disallowed by robots.txt.", cleanURL)
+			wg.Done()
+			continue
+		}
+
+		attemptCtx, cancel := job.attemptContext(ctx)
+		fetch, err := fetchOnce(attemptCtx, client, spooler, store, runStart, urlInfo, cleanURL)
+		cancel()
+		scheduler.Done(job)
+		if err != nil && ctx.Err() != nil {
+			// The run is stopping, so the attempt cancelled with it is not retried.
+			job.failedAttempts = append(job.failedAttempts, &Attempt{Number: job.attempt, Message: err.Error()})
+			errChan <- job.stoppedError(stopReason(ctx), fmt.Sprintf("during attempt %d", job.attempt), job.attempt)
+			log.Warning("Stopped fetching %s: %s.", cleanURL, err)
+			wg.Done()
+			continue
+		}
+		if failure, retryable := failedAttempt(job, fetch, err); failure != nil {
+			job.failedAttempts = append(job.failedAttempts, failure)
+			delay := urlInfo.Retry.Delay(job.attempt)
+			if retryable && job.attempt < urlInfo.Retry.Attempts && !job.pastDeadline(time.Now().Add(delay)) {
+				fetch.Close()
+				// Let the scheduler hand the retry to a fetcher after the backoff, instead of waiting here.
+				log.Warning("Attempt %d of %s failed (%s), retrying in %s.", job.attempt, cleanURL, failure.Message, delay)
+				job.attempt++
+				job.notBefore = time.Now().Add(delay)
+				if scheduler.Add(job) {
+					continue
+				}
+				// The run is stopping, so the retry is not attempted.
+				errChan <- job.stoppedError(stopReason(ctx), fmt.Sprintf("before attempt %d", job.attempt), job.attempt-1)
+				wg.Done()
+				continue
+			}
 		}
 
-		// Fetch the URL and catch any error.
-		resp, err := http.Get(cleanURL)
 		if err != nil {
-			errChan <- &FetchError{Cleaned: cleanURL, Original: urlInfo.Link, Message: err.Error()}
+			reason := "request"
+			if bodyErr, ok := err.(*BodyError); ok {
+				reason = bodyErr.Reason
+			} else if job.pastDeadline(time.Now()) {
+				reason = "deadline"
+			}
+			errChan <- &FetchError{urlInfo: urlInfo, Cleaned: cleanURL, Original: urlInfo.Link, Reason: reason, Message: err.Error(), Attempts: job.attempt, FailedAttempts: job.failedAttempts}
 			log.Critical("Error fetching %s: %s.", cleanURL, err)
 			wg.Done() // Decrement the counter so as to not wait for this item to be processed.
 			continue
 		}
+		fetch.attempts = job.attempt
+		fetch.failedAttempts = job.failedAttempts
+
+		if !fetch.success() {
+			switch urlInfo.StatusPolicy {
+			case "store":
+				log.Warning("Storing %s despite status %s.", cleanURL, fetch.response.Status)
+			case "skip":
+				log.Notice("Skipping %s after status %s.", cleanURL, fetch.response.Status)
+				fetch.Close()
+				wg.Done()
+				continue
+			default:
+				errChan <- &FetchError{urlInfo: urlInfo, Cleaned: cleanURL, Original: urlInfo.Link, Status: fetch.response.StatusCode, Reason: "status", Message: fmt.Sprintf("HTTP status %s", fetch.response.Status),
+					Attempts: fetch.attempts, FailedAttempts: fetch.failedAttempts}
+				log.Error("Error fetching %s: HTTP status %s.", cleanURL, fetch.response.Status)
+				fetch.Close()
+				wg.Done()
+				continue
+			}
+		}
+		s3chan <- fetch
+	}
+}
+
+// failedAttempt returns the failed attempt of the job from the result of the fetch, and whether it can be retried.
+// Returns nil if the attempt did not fail.
+func failedAttempt(job *fetchJob, fetch *HTTPFetch, err error) (*Attempt, bool) {
+	if err != nil {
+		return &Attempt{Number: job.attempt, Message: err.Error()}, job.urlInfo.Retry.RetryableError(err)
+	}
+	if !fetch.success() {
+		failure := &Attempt{Number: job.attempt, Status: fetch.response.StatusCode, Message: fmt.Sprintf("HTTP status %s", fetch.response.Status)}
+		return failure, job.urlInfo.StatusPolicy == "retry" || job.urlInfo.Retry.RetryableStatus(fetch.response.StatusCode)
+	}
+	return nil, false
+}
+
+// fetchOnce fetches the URL once and returns the HTTPFetch. The body is streamed through the hasher into a buffer,
+// spooled to disk if large, and a BodyError is returned if it is truncated or larger than the maximum body size of the URL.
+// The request and the reading of the body are cancelled with the provided context.
+func fetchOnce(ctx context.Context, client *HTTPClient, spooler *Spooler, store Storage, runStart time.Time, urlInfo *URLInfo, cleanURL string) (*HTTPFetch, error) {
+	start := time.Now()
+
+	// Fetch the URL and catch any error.
+	req, err := urlInfo.NewRequest(ctx, cleanURL)
+	if err != nil {
+		return nil, err
+	}
+	// Only the GET requests are conditional, the others not being cached.
+	var validators *Validators
+	if urlInfo.Method == "GET" {
+		validators = ValidatorsFromStorage(store, storageRoot(), urlInfo.Link)
+	}
+	if validators != nil && validators.FetchTime.Before(runStart) {
+		validators.SetHeaders(req)
+	} else {
+		validators = nil
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 
-		// Computing the duration of the request now.
-		duration := time.Now().Sub(start)
-		// Read the response body, and close it.
-		respBody, ioerr := ioutil.ReadAll(resp.Body)
-		defer resp.Body.Close()
-		if ioerr != nil {
-			panic(ioerr)
+	// Computing the duration of the request now.
+	duration := time.Now().Sub(start)
+	if resp.StatusCode == http.StatusNotModified && validators != nil {
+		// The content is the same as in the previous fetch, so there is no body to read.
+		log.Debug("%s was not modified since %s.", cleanURL, validators.FetchTime)
+		return &HTTPFetch{urlInfo: urlInfo, cleanURL: cleanURL, response: resp, startTime: start, duration: duration, checksum: validators.Checksum, unchanged: true}, nil
+	}
+	if resp.ContentLength > urlInfo.MaxBodySize {
+		return nil, &BodyError{Reason: "oversized", Err: fmt.Errorf("body of %d bytes is larger than the maximum of %d bytes", resp.ContentLength, urlInfo.MaxBodySize)}
+	}
+	// Read the response body while computing the SHA384 checksum, reading one more byte than allowed to detect larger bodies.
+	hash := sha512.New384()
+	body := spooler.NewBuffer()
+	size, err := io.Copy(io.MultiWriter(body, hash), io.LimitReader(resp.Body, urlInfo.MaxBodySize+1))
+	if err != nil {
+		body.Close()
+		if _, isSpoolErr := err.(*os.PathError); isSpoolErr {
+			return nil, err // The spool file could not be written.
 		}
-		// Computing the SHA384 checksum.
-		hash := sha512.New384()
-		hash.Write(respBody)
-		checksum := hex.EncodeToString(hash.Sum(nil))
-		s3chan <- &HTTPFetch{urlInfo: urlInfo, response: resp, body: respBody, startTime: start, duration: duration, checksum: checksum}
+		return nil, &BodyError{Reason: "truncated", Err: err}
+	}
+	if size > urlInfo.MaxBodySize {
+		body.Close()
+		return nil, &BodyError{Reason: "oversized", Err: fmt.Errorf("body is larger than the maximum of %d bytes", urlInfo.MaxBodySize)}
 	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	return &HTTPFetch{urlInfo: urlInfo, cleanURL: cleanURL, response: resp, body: body, startTime: start, duration: duration, checksum: checksum}, nil
+}
+
+// Error returns the message of the body error.
+func (bodyErr *BodyError) Error() string {
+	if bodyErr.Reason == "truncated" {
+		return fmt.Sprintf("truncated body: %s", bodyErr.Err)
+	}
+	return bodyErr.Err.Error()
+}
+
+// Close releases the body of the fetch, if any, once it is stored or discarded.
+func (fetch *HTTPFetch) Close() {
+	if fetch == nil || fetch.body == nil {
+		return
+	}
+	if err := fetch.body.Close(); err != nil {
+		log.Warning("Could not remove the spool file of %s: %s", fetch.urlInfo.Link, err)
+	}
+}
+
+// success returns whether the fetch was successful, i.e. whether the status is 2xx or the content is unchanged.
+func (fetch *HTTPFetch) success() bool {
+	return fetch.unchanged || (fetch.response.StatusCode >= 200 && fetch.response.StatusCode < 300)
+}
+
+// headers returns the recorded response headers of the fetch, for the output log.
+func (fetch *HTTPFetch) headers() []*Header {
+	var headers []*Header
+	for _, name := range recordedHeaders {
+		if value := fetch.response.Header.Get(name); value != "" {
+			headers = append(headers, &Header{Name: name, Value: value})
+		}
+	}
+	return headers
+}
+
+// contentType returns the original content type of the fetch, with its charset if any.
+func (fetch *HTTPFetch) contentType() string {
+	if contType := fetch.response.Header.Get("Content-Type"); contType != "" {
+		return contType
+	}
+	return defaultContentType
+}
+
+// metadata returns the metadata of the content of the fetch, with all the response headers but the cookies.
+func (fetch *HTTPFetch) metadata() *ContentMetadata {
+	names := make([]string, 0, len(fetch.response.Header))
+	for name := range fetch.response.Header {
+		if !unrecordedHeaders[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var headers []*Header
+	for _, name := range names {
+		for _, value := range fetch.response.Header[name] {
+			headers = append(headers, &Header{Name: name, Value: value})
+		}
+	}
+	return &ContentMetadata{ContentType: fetch.contentType(), Encoding: fetch.encoding, Status: fetch.response.StatusCode, FinalLink: fetch.response.Request.URL.String(),
+		FetchTime: fetch.startTime, Headers: headers}
+}
+
+// ValidatorsFromResponse returns the cache validators of the HTTPFetch, or nil if the response has none or the request is not a GET.
+func ValidatorsFromResponse(fetch *HTTPFetch) *Validators {
+	if fetch.urlInfo.Method != "GET" {
+		return nil
+	}
+	etag := fetch.response.Header.Get("ETag")
+	lastModified := fetch.response.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return nil
+	}
+	return &Validators{ETag: etag, LastModified: lastModified, Checksum: fetch.checksum, FetchTime: fetch.startTime}
+}
+
+// ValidatorsFromStorage returns the cache validators of the link from the storage, or nil if there are none.
+func ValidatorsFromStorage(store Storage, root string, link string) *Validators {
+	data, notFoundErr := store.Get(validatorsPath(root, link))
+	if notFoundErr != nil {
+		return nil
+	}
+	fields := strings.Split(strings.TrimSuffix(string(data), "\n"), "\t")
+	if len(fields) != 4 {
+		log.Warning("Ignoring invalid cache validators of %s.", link)
+		return nil
+	}
+	fetchTime, err := time.Parse(time.RFC3339Nano, fields[0])
+	if err != nil {
+		log.Warning("Ignoring cache validators of %s: %s", link, err)
+		return nil
+	}
+	return &Validators{FetchTime: fetchTime, Checksum: fields[1], ETag: fields[2], LastModified: fields[3]}
+}
+
+// SetHeaders sets the conditional request headers from the cache validators.
+func (validators *Validators) SetHeaders(req *http.Request) {
+	if validators.ETag != "" {
+		req.Header.Set("If-None-Match", validators.ETag)
+	}
+	if validators.LastModified != "" {
+		req.Header.Set("If-Modified-Since", validators.LastModified)
+	}
+}
+
+// String returns the cache validators as stored: the fetch time, the checksum, the ETag and the Last-Modified date, tab separated.
+func (validators *Validators) String() string {
+	return fmt.Sprintf("%s\t%s\t%s\t%s\n", validators.FetchTime.Format(time.RFC3339Nano), validators.Checksum, validators.ETag, validators.LastModified)
+}
+
+// validatorsPath returns the path of the cache validators of a link, from the SHA384 checksum of the link.
+func validatorsPath(root string, link string) string {
+	return fmt.Sprintf("%s/cache/validators/%s", root, linkChecksum(link))
 }
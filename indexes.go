@@ -1,7 +1,12 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
 	"fmt"
+	"net/url"
+	"strings"
 )
 
 // IndexInterface details what can be considered an index interface.
@@ -10,13 +15,58 @@ type IndexInterface interface {
 	Content(*HTTPFetch, string) string // Returns the content to store in the index from the HTTPFetch and the path to the content.
 }
 
-// CanonicalIndex is the canonical SHA384 index, which cannot be disabled.
+// SelectiveIndexInterface details an index which only indexes some of the fetches.
+type SelectiveIndexInterface interface {
+	IndexInterface
+	Accepts(*HTTPFetch) bool // Returns whether the HTTPFetch must be written to this index.
+}
+
+// canonicalIndexName is the name of the canonical index in the configuration file.
+const canonicalIndexName = "checksum"
+
+// indexRegistry maps the index names, as used in the configuration file, to their implementation.
+// New indexes must be added here to be enabled from the configuration file.
+var indexRegistry = map[string]IndexInterface{
+	"by_link":         ByLinkIndex{},
+	"novel_by_parser": NovelByParserIndex{},
+}
+
+// IndexesFromConfig returns the implementations of the enabled indexes of the configuration file, in order.
+// The canonical index is not returned since it is always written first. An error is returned for unknown index names.
+func IndexesFromConfig(indexes []*Index) ([]IndexInterface, error) {
+	var enabled []IndexInterface
+	for _, index := range indexes {
+		if index.Name == canonicalIndexName {
+			if !index.Enabled {
+				log.Warning("The canonical index `%s` cannot be disabled.", canonicalIndexName)
+			}
+			continue
+		}
+		impl, known := indexRegistry[index.Name]
+		if !known {
+			return nil, fmt.Errorf("unknown index `%s` in configuration file", index.Name)
+		}
+		if !index.Enabled {
+			log.Notice("Index `%s` is disabled.", index.Name)
+			continue
+		}
+		log.Notice("Index `%s` is enabled.", index.Name)
+		enabled = append(enabled, impl)
+	}
+	return enabled, nil
+}
+
+// canonicalFirstEntry is the name of the first entry of a checksum in the canonical index, which sorts before the other entries.
+const canonicalFirstEntry = "0-first"
+
+// CanonicalIndex is the canonical SHA384 index, which cannot be disabled. Each checksum is a directory with one object per
+// entry, so that concurrent writers never overwrite each other's entries.
 type CanonicalIndex struct {
 }
 
-// Path returns the
+// Path on CanonicalIndex returns the directory of the entries of the checksum, with a trailing slash.
 func (idx CanonicalIndex) Path(fetch *HTTPFetch, root string) string {
-	return fmt.Sprintf("%s/index/sha384_checksum/%s", root, fetch.checksum)
+	return fmt.Sprintf("%s/index/sha384_checksum/%s/", root, fetch.checksum)
 }
 
 // Content on ChecksumIndex returns the link, the time of the fetch, the duration of the fetch and the parser for that fetch.
@@ -24,3 +74,126 @@ func (idx CanonicalIndex) Content(fetch *HTTPFetch, contentPath string) string {
 	return fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\n", contentPath, fetch.urlInfo.Link, fetch.response.Request.URL.RequestURI(),
 		fetch.startTime.Format("2006-01-02T15:04:05.000Z"), fetch.duration, fetch.urlInfo.Parser.Name)
 }
+
+// WriteEntry writes the entry of the fetch to the canonical index, and returns its path and whether the content is novel.
+// The first entry of a checksum is claimed with a conditional write, so that a single fetch finds the content novel across
+// the writers and the gofetch instances, unless the checksum is in the single index object written by previous versions.
+// The other entries have a unique name, which is kept on the fetch so that writing the entry again overwrites it.
+func (idx CanonicalIndex) WriteEntry(store Storage, fetch *HTTPFetch, root string, contentPath string) (string, bool, error) {
+	indexPath := idx.Path(fetch, root)
+	content := []byte(idx.Content(fetch, contentPath))
+	legacy, err := store.Exists(strings.TrimSuffix(indexPath, "/"))
+	if err != nil {
+		return "", false, err
+	}
+	if fetch.entryName == "" {
+		claimed, err := store.PutIfAbsent(indexPath+canonicalFirstEntry, content, "text/plain")
+		if err != nil {
+			return "", false, err
+		}
+		if claimed {
+			return indexPath + canonicalFirstEntry, !legacy, nil
+		}
+		if fetch.entryName, err = indexEntryName(fetch); err != nil {
+			return "", false, err
+		}
+	}
+	entryPath := indexPath + fetch.entryName
+	return entryPath, false, store.Put(entryPath, content, "text/plain")
+}
+
+// indexEntryName returns a unique name for an entry of an index, from the start time of the fetch
+// and a random suffix, such that the entries sort by time.
+func indexEntryName(fetch *HTTPFetch) (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s", fetch.startTime.UTC().Format("20060102T150405.000000000Z"), hex.EncodeToString(suffix)), nil
+}
+
+// ReadIndex returns the entries of an index, e.g. of a link in the by_link index, given its directory, in order.
+func ReadIndex(store Storage, indexPath string) ([]byte, error) {
+	entries, err := store.List(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	for _, entry := range entries {
+		entryData, err := store.Get(entry)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, entryData...)
+	}
+	return data, nil
+}
+
+// ReadChecksumIndex returns the entries of a checksum in the canonical index, given its directory, in order.
+// The entries of the single index object written by previous versions come first.
+func ReadChecksumIndex(store Storage, indexPath string) ([]byte, error) {
+	var data []byte
+	legacyPath := strings.TrimSuffix(indexPath, "/")
+	if exists, err := store.Exists(legacyPath); err != nil {
+		return nil, err
+	} else if exists {
+		if data, err = store.Get(legacyPath); err != nil {
+			return nil, err
+		}
+	}
+	entries, err := ReadIndex(store, indexPath)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, entries...), nil
+}
+
+// ByLinkIndex is the index of the checksums returned by a given requested link over time. Each link is a directory
+// with one object per entry, like the checksums of the canonical index.
+type ByLinkIndex struct {
+}
+
+// Path on ByLinkIndex returns the directory of the entries from the SHA384 checksum of the requested link, with a trailing slash.
+func (idx ByLinkIndex) Path(fetch *HTTPFetch, root string) string {
+	return fmt.Sprintf("%s/index/by_link/%s/", root, linkChecksum(fetch.urlInfo.Link))
+}
+
+// Content on ByLinkIndex returns the time of the fetch, the checksum of the content, the HTTP status code and the duration of the fetch.
+func (idx ByLinkIndex) Content(fetch *HTTPFetch, contentPath string) string {
+	return fmt.Sprintf("%s\t%s\t%d\t%s\n", fetch.startTime.Format("2006-01-02T15:04:05.000Z"), fetch.checksum,
+		fetch.response.StatusCode, fetch.duration)
+}
+
+// NovelByParserIndex is the daily index of the novel content per parser name. Each day is a directory with one object
+// per entry, like the checksums of the canonical index.
+type NovelByParserIndex struct {
+}
+
+// Accepts on NovelByParserIndex only accepts the novel content.
+func (idx NovelByParserIndex) Accepts(fetch *HTTPFetch) bool {
+	return fetch.novel
+}
+
+// Path on NovelByParserIndex returns the directory of the entries from the parser name and the day of the fetch, with a trailing slash.
+func (idx NovelByParserIndex) Path(fetch *HTTPFetch, root string) string {
+	return fmt.Sprintf("%s/index/novel_by_parser/%s/%s/", root, parserDirectory(fetch.urlInfo.Parser.Name), fetch.startTime.UTC().Format("2006-01-02"))
+}
+
+// parserDirectory returns the parser name escaped as a single path segment, dots included so that it cannot be
+// a relative directory.
+func parserDirectory(name string) string {
+	return strings.Replace(url.PathEscape(name), ".", "%2E", -1)
+}
+
+// Content on NovelByParserIndex returns the path to the content, the requested link and the parser metadata on a single line.
+func (idx NovelByParserIndex) Content(fetch *HTTPFetch, contentPath string) string {
+	parserXML := strings.TrimSpace(strings.NewReplacer("\r", " ", "\n", " ", "\t", " ").Replace(fetch.urlInfo.Parser.XML))
+	return fmt.Sprintf("%s\t%s\t%s\n", contentPath, fetch.urlInfo.Link, parserXML)
+}
+
+// linkChecksum returns the hex encoded SHA384 checksum of the provided link.
+func linkChecksum(link string) string {
+	hash := sha512.New384()
+	hash.Write([]byte(link))
+	return hex.EncodeToString(hash.Sum(nil))
+}
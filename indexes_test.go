@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestIndexes tests the index registry and the index implementations.
+func TestIndexes(t *testing.T) {
+	Convey("The index tests, ", t, func() {
+		Convey("IndexesFromConfig returns the enabled indexes only", func() {
+			indexes, err := IndexesFromConfig([]*Index{{Name: "checksum", Enabled: false}, {Name: "by_link", Enabled: true}})
+			So(err, ShouldBeNil)
+			So(len(indexes), ShouldEqual, 1)
+			So(indexes[0], ShouldHaveSameTypeAs, ByLinkIndex{})
+
+			indexes, err = IndexesFromConfig([]*Index{{Name: "by_link", Enabled: false}})
+			So(err, ShouldBeNil)
+			So(len(indexes), ShouldEqual, 0)
+		})
+
+		Convey("IndexesFromConfig rejects unknown indexes, even if disabled", func() {
+			_, err := IndexesFromConfig([]*Index{{Name: "carrots", Enabled: false}})
+			So(err, ShouldNotBeNil)
+		})
+
+		fetch := testHTTPFetch("http://example.com/feed", "rss")
+
+		Convey("ByLinkIndex uses the requested link for its path", func() {
+			idx := ByLinkIndex{}
+			So(idx.Path(fetch, "/gofetch"), ShouldEqual, "/gofetch/index/by_link/"+linkChecksum("http://example.com/feed")+"/")
+			rows := strings.Split(strings.TrimSuffix(idx.Content(fetch, "/gofetch/sha384_content/abc"), "\n"), "\t")
+			So(rows, ShouldResemble, []string{"2015-04-13T10:20:30.000Z", "abc", "200", "1.5s"})
+		})
+
+		fileRoot, _ := ioutil.TempDir("", "gofetch-index-")
+		defer os.RemoveAll(fileRoot)
+		for _, store := range []Storage{NewMemoryStorage(), &FileStorage{root: fileRoot}} {
+			store := store
+			Convey("CanonicalIndex finds a single novel fetch among concurrent writers with the storage "+fmt.Sprintf("%T", store), func() {
+				idx := CanonicalIndex{}
+				So(idx.Path(fetch, "/gofetch"), ShouldEqual, "/gofetch/index/sha384_checksum/abc/")
+				var wg sync.WaitGroup
+				novelties := make(chan bool, 10)
+				for i := 0; i < 10; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						_, novel, err := idx.WriteEntry(store, testHTTPFetch("http://example.com/feed", "rss"), "/gofetch", "/gofetch/sha384_content/abc")
+						novelties <- novel && err == nil
+					}()
+				}
+				wg.Wait()
+				close(novelties)
+				novel := 0
+				for isNovel := range novelties {
+					if isNovel {
+						novel++
+					}
+				}
+				So(novel, ShouldEqual, 1)
+				entries, _ := store.List("/gofetch/index/sha384_checksum/abc/")
+				So(len(entries), ShouldEqual, 10)
+				So(entries[0], ShouldEqual, "/gofetch/index/sha384_checksum/abc/0-first")
+				data, err := ReadChecksumIndex(store, "/gofetch/index/sha384_checksum/abc/")
+				So(err, ShouldBeNil)
+				So(strings.Count(string(data), "\n"), ShouldEqual, 10)
+			})
+		}
+
+		Convey("CanonicalIndex reads the index of previous versions, whose checksums are not novel", func() {
+			store := NewMemoryStorage()
+			store.Put("/gofetch/index/sha384_checksum/abc", []byte("legacy\n"), "text/plain")
+			idx := CanonicalIndex{}
+			entryPath, novel, err := idx.WriteEntry(store, fetch, "/gofetch", "/gofetch/sha384_content/abc")
+			So(err, ShouldBeNil)
+			So(novel, ShouldBeFalse)
+			So(entryPath, ShouldEqual, "/gofetch/index/sha384_checksum/abc/0-first")
+			data, err := ReadChecksumIndex(store, "/gofetch/index/sha384_checksum/abc/")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldStartWith, "legacy\n/gofetch/sha384_content/abc\t")
+		})
+
+		Convey("The entries of the other indexes are only read from their directory", func() {
+			store := NewMemoryStorage()
+			store.Put("/gofetch/index/by_link/abc", []byte("other\n"), "text/plain")
+			store.Put("/gofetch/index/by_link/abc/entry", []byte("entry\n"), "text/plain")
+			data, err := ReadIndex(store, "/gofetch/index/by_link/abc/")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "entry\n")
+		})
+
+		Convey("NovelByParserIndex only accepts novel content, per parser and per day", func() {
+			idx := NovelByParserIndex{}
+			So(idx.Accepts(fetch), ShouldBeFalse)
+			fetch.novel = true
+			So(idx.Accepts(fetch), ShouldBeTrue)
+			So(idx.Path(fetch, "/gofetch"), ShouldEqual, "/gofetch/index/novel_by_parser/rss/2015-04-13/")
+			fetch.urlInfo.Parser.Name = "../raw articles/v1.2"
+			So(idx.Path(fetch, "/gofetch"), ShouldEqual, "/gofetch/index/novel_by_parser/%2E%2E%2Fraw%20articles%2Fv1%2E2/2015-04-13/")
+			So(idx.Content(fetch, "/gofetch/sha384_content/abc"), ShouldEqual, "/gofetch/sha384_content/abc\thttp://example.com/feed\t<feed id=\"1\" />\n")
+		})
+
+		Convey("The URLs without a parser name are rejected", func() {
+			So((&Config{Urls: []*URLInfo{{Link: "http://example.com/feed"}}}).Validate(), ShouldNotBeNil)
+			So((&Config{Urls: []*URLInfo{{Link: "http://example.com/feed", Parser: Parser{Name: "rss"}}}}).Validate(), ShouldBeNil)
+		})
+	})
+}
+
+// testHTTPFetch returns an HTTPFetch of the given link and parser, whose content checksum is "abc".
+func testHTTPFetch(link string, parser string) *HTTPFetch {
+	reqURL, _ := url.Parse(link)
+	body := (&Spooler{threshold: 1 << 20}).NewBuffer()
+	body.Write([]byte("content"))
+	return &HTTPFetch{urlInfo: &URLInfo{Link: link, Parser: Parser{Name: parser, XML: "\n\t<feed id=\"1\" />\n"}},
+		response: &http.Response{StatusCode: 200, Request: &http.Request{URL: reqURL}}, body: body,
+		startTime: time.Date(2015, 4, 13, 10, 20, 30, 0, time.UTC), duration: 1500 * time.Millisecond, checksum: "abc"}
+}
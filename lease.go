@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LeaseCoordinator details how the writers agree on which of them uploads a content, so that it is uploaded once.
+type LeaseCoordinator interface {
+	Acquire(checksum string) (bool, error) // Returns whether the lease of the checksum was acquired, i.e. whether no other writer holds it.
+	Release(checksum string) error         // Releases the lease of the checksum, once its content is uploaded or could not be.
+}
+
+// LocalLeases is the set of the checksums being uploaded by the writers of this gofetch instance.
+type LocalLeases struct {
+	sync.Mutex                 // Protects the checksums.
+	checksums  map[string]bool // Stores the checksums whose lease is held.
+}
+
+// StorageLeases coordinates the gofetch instances sharing a storage with a lease object per checksum, created with
+// a conditional write. The local lease is acquired first, so that the writers of an instance do not race on the storage.
+type StorageLeases struct {
+	local *LocalLeases  // Stores the leases of this instance.
+	store Storage       // Stores the storage of the lease objects.
+	owner string        // Stores the unique name of this instance, written in its lease objects.
+	ttl   time.Duration // Stores the duration of a lease, after which another instance takes it over, e.g. if its owner crashed.
+}
+
+// NewLocalLeases returns a new LocalLeases, without any lease held.
+func NewLocalLeases() *LocalLeases {
+	return &LocalLeases{checksums: make(map[string]bool)}
+}
+
+// Acquire on LocalLeases acquires the lease of the checksum unless a writer of this instance holds it.
+func (leases *LocalLeases) Acquire(checksum string) (bool, error) {
+	leases.Lock()
+	defer leases.Unlock()
+	if leases.checksums[checksum] {
+		return false, nil
+	}
+	leases.checksums[checksum] = true
+	return true, nil
+}
+
+// Release on LocalLeases releases the lease of the checksum.
+func (leases *LocalLeases) Release(checksum string) error {
+	leases.Lock()
+	defer leases.Unlock()
+	delete(leases.checksums, checksum)
+	return nil
+}
+
+// NewStorageLeases returns a new StorageLeases of the provided instance owner, whose leases last for the provided duration.
+func NewStorageLeases(store Storage, owner string, ttl time.Duration) *StorageLeases {
+	return &StorageLeases{local: NewLocalLeases(), store: store, owner: owner, ttl: ttl}
+}
+
+// Acquire on StorageLeases acquires the lease of the checksum unless a writer of this instance, or of another instance
+// whose lease has not expired, holds it. Note that two instances taking over the same expired lease may both acquire it.
+func (leases *StorageLeases) Acquire(checksum string) (acquired bool, err error) {
+	if acquired, err = leases.local.Acquire(checksum); !acquired || err != nil {
+		return acquired, err
+	}
+	defer func() {
+		if !acquired {
+			leases.local.Release(checksum)
+		}
+	}()
+	path := leasePath(checksum)
+	lease := []byte(fmt.Sprintf("%s\t%s\n", leases.owner, time.Now().Add(leases.ttl).UTC().Format(time.RFC3339Nano)))
+	if acquired, err = leases.store.PutIfAbsent(path, lease, "text/plain"); acquired || err != nil {
+		return acquired, err
+	}
+	held, err := leases.store.Get(path)
+	if err != nil {
+		return false, err
+	}
+	fields := strings.Fields(string(held))
+	if len(fields) == 2 {
+		if expiry, err := time.Parse(time.RFC3339Nano, fields[1]); err == nil && time.Now().Before(expiry) {
+			return false, nil
+		}
+	}
+	log.Warning("Taking over the expired or invalid lease of %s: %s", checksum, strings.TrimSpace(string(held)))
+	if err = leases.store.Delete(path); err != nil {
+		return false, err
+	}
+	return leases.store.PutIfAbsent(path, lease, "text/plain")
+}
+
+// Release on StorageLeases deletes the lease object of the checksum unless another instance took it over, and releases its
+// local lease. Note that the lease object is read before being deleted, so a lease taken over in between is deleted.
+func (leases *StorageLeases) Release(checksum string) error {
+	defer leases.local.Release(checksum)
+	path := leasePath(checksum)
+	held, err := leases.store.Get(path)
+	if err != nil {
+		if exists, existsErr := leases.store.Exists(path); existsErr == nil && !exists {
+			return nil
+		}
+		return err
+	}
+	if fields := strings.Fields(string(held)); len(fields) == 0 || fields[0] != leases.owner {
+		log.Warning("Not releasing the lease of %s, which was taken over: %s", checksum, strings.TrimSpace(string(held)))
+		return nil
+	}
+	return leases.store.Delete(path)
+}
+
+// leasePath returns the path of the lease object of a checksum.
+func leasePath(checksum string) string {
+	return fmt.Sprintf("%s/lease/sha384_content/%s", storageRoot(), checksum)
+}
+
+// LeasesFromOS returns the lease coordinator of the content uploads as defined in the environment (cf. README.md),
+// or an error if it cannot be used.
+func LeasesFromOS(store Storage) (LeaseCoordinator, error) {
+	switch backend := os.Getenv("CONTENT_LEASES"); backend {
+	case "", "local":
+		log.Notice("Coordinating the content uploads within this instance.\n")
+		return NewLocalLeases(), nil
+	case "storage":
+		ttl := time.Duration(intFromEnvVar("CONTENT_LEASE_TTL", 3600)) * time.Second
+		suffix := make([]byte, 4)
+		if _, err := rand.Read(suffix); err != nil {
+			return nil, err
+		}
+		owner := fmt.Sprintf("%s_%s_%s-%s", os.Getenv("FETCH_ID"), os.Getenv("FETCH_OFFSET"), os.Getenv("FETCH_LIMIT"), hex.EncodeToString(suffix))
+		log.Notice("Coordinating the content uploads across instances with leases of %s in the storage, as %s.\n", ttl, owner)
+		return NewStorageLeases(store, owner, ttl), nil
+	default:
+		return nil, fmt.Errorf("unknown content leases `%s`", backend)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+// TestLeases tests the local and the storage lease coordinators.
+func TestLeases(t *testing.T) {
+	Convey("The lease tests, ", t, func() {
+		Convey("LocalLeases grants a lease to a single writer until it is released", func() {
+			leases := NewLocalLeases()
+			acquired, err := leases.Acquire("abc")
+			So(err, ShouldBeNil)
+			So(acquired, ShouldBeTrue)
+			acquired, _ = leases.Acquire("abc")
+			So(acquired, ShouldBeFalse)
+			acquired, _ = leases.Acquire("def")
+			So(acquired, ShouldBeTrue)
+			So(leases.Release("abc"), ShouldBeNil)
+			acquired, _ = leases.Acquire("abc")
+			So(acquired, ShouldBeTrue)
+		})
+
+		Convey("StorageLeases grants a lease to a single instance until it is released or expires", func() {
+			store := NewMemoryStorage()
+			first := NewStorageLeases(store, "first", time.Hour)
+			second := NewStorageLeases(store, "second", time.Hour)
+			acquired, err := first.Acquire("abc")
+			So(err, ShouldBeNil)
+			So(acquired, ShouldBeTrue)
+			acquired, err = second.Acquire("abc")
+			So(err, ShouldBeNil)
+			So(acquired, ShouldBeFalse)
+			// The local lease of the second instance is released when the lease object is held.
+			So(second.local.checksums, ShouldBeEmpty)
+			So(first.Release("abc"), ShouldBeNil)
+			acquired, _ = second.Acquire("abc")
+			So(acquired, ShouldBeTrue)
+
+			expired := NewStorageLeases(store, "expired", -time.Second)
+			acquired, _ = expired.Acquire("def")
+			So(acquired, ShouldBeTrue)
+			acquired, _ = first.Acquire("def")
+			So(acquired, ShouldBeTrue)
+			lease, _ := store.Get(leasePath("def"))
+			So(string(lease), ShouldStartWith, "first\t")
+			// The instance whose lease was taken over does not release the lease of the other instance.
+			So(expired.Release("def"), ShouldBeNil)
+			lease, _ = store.Get(leasePath("def"))
+			So(string(lease), ShouldStartWith, "first\t")
+			So(first.Release("def"), ShouldBeNil)
+			exists, _ := store.Exists(leasePath("def"))
+			So(exists, ShouldBeFalse)
+		})
+	})
+}
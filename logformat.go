@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+)
+
+// logFormats are the accepted formats of the log of a run, the first one being the default.
+var logFormats = []string{"xml", "json", "jsonl"}
+
+// jsonLogVersion is the version of the schema of the log of a run in JSON and in JSON Lines (cf. docs/fetches.schema.json).
+// It is increased when a field is removed or changes meaning, but not when a field is added.
+const jsonLogVersion = 1
+
+// jsonLog allows for marshling of the log of a run in JSON, with the version of its schema.
+type jsonLog struct {
+	Version int `json:"version"`
+	*Fetches
+}
+
+// jsonLine allows for marshling of the kind of a record of the log of a run in JSON Lines, with the version of its schema.
+type jsonLine struct {
+	Version int    `json:"version"`
+	Record  string `json:"record"` // Either "fetch", "error", "unattempted", "dead_letter", or "meta" for the last line.
+}
+
+// marshalLog returns the log of a run in the provided format, with its content type.
+func marshalLog(fetches *Fetches, format string) ([]byte, string, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	switch format {
+	case "xml":
+		content, err := xml.MarshalIndent(fetches, "", "\t")
+		return append([]byte(xml.Header), content...), "application/xml", err
+	case "json":
+		encoder.SetIndent("", "\t")
+		err := encoder.Encode(&jsonLog{Version: jsonLogVersion, Fetches: fetches})
+		return buffer.Bytes(), "application/json", err
+	case "jsonl":
+		// Each record is a line, the meta information of the run being the last one.
+		line := func(record string) jsonLine {
+			return jsonLine{Version: jsonLogVersion, Record: record}
+		}
+		for _, fetch := range fetches.Fetch {
+			if err := encoder.Encode(struct {
+				jsonLine
+				*Fetch
+			}{line("fetch"), fetch}); err != nil {
+				return nil, "", err
+			}
+		}
+		for _, fetchErr := range fetches.FetchError {
+			if err := encoder.Encode(struct {
+				jsonLine
+				*FetchError
+			}{line("error"), fetchErr}); err != nil {
+				return nil, "", err
+			}
+		}
+		for _, unattempted := range fetches.Unattempted {
+			if err := encoder.Encode(struct {
+				jsonLine
+				*Unattempted
+			}{line("unattempted"), unattempted}); err != nil {
+				return nil, "", err
+			}
+		}
+		for _, letter := range fetches.DeadLetters {
+			if err := encoder.Encode(struct {
+				jsonLine
+				*DeadLetter
+			}{line("dead_letter"), letter}); err != nil {
+				return nil, "", err
+			}
+		}
+		err := encoder.Encode(struct {
+			jsonLine
+			*Meta
+		}{line("meta"), fetches.Meta})
+		return buffer.Bytes(), "application/x-ndjson", err
+	default:
+		return nil, "", fmt.Errorf("unknown log format `%s`", format)
+	}
+}
+
+// validLogFormat returns whether the provided log format is accepted.
+func validLogFormat(format string) bool {
+	for _, accepted := range logFormats {
+		if format == accepted {
+			return true
+		}
+	}
+	return false
+}
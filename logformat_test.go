@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// TestLogFormats tests the marshling of the log of a run in each format.
+func TestLogFormats(t *testing.T) {
+	Convey("The log format tests, ", t, func() {
+		fetch := fetchLog(NewMemoryStorage(), testHTTPFetch("http://example.com/feed?a=1&b=2", "rss"), "/gofetch/index/sha384_checksum/abc/0-first", "/gofetch/sha384_content/abc")
+		fetch.urlInfo = nil
+		fetches := &Fetches{Fetch: []*Fetch{fetch},
+			FetchError:  []*FetchError{{Original: "http://example.com/error", Cleaned: "http://example.com/error", Status: 404, Reason: "status", Message: "HTTP status 404 Not Found", Attempts: 1}},
+			Unattempted: []*Unattempted{{Original: "http://example.com/unattempted", Cleaned: "http://example.com/unattempted"}},
+			DeadLetters: []*DeadLetter{{Original: "http://example.com/dead", Cleaned: "http://example.com/dead", Checksum: "def", Message: "storage unavailable", Attempts: 1,
+				FailedAttempts: []*Attempt{{Number: 1, Message: "storage unavailable"}}}},
+			Meta: &Meta{Result: &Result{Status: "partial"}, Report: &Report{Novel: 1, Errors: 1, Total: 3, Unattempted: 1, DeadLetters: 1},
+				FetchDuration: &FetchDuration{Hours: 1, Minutes: 60, Seconds: 3600}}}
+
+		Convey("The XML log is the Fetches document", func() {
+			content, contType, err := marshalLog(fetches, "xml")
+			So(err, ShouldBeNil)
+			So(contType, ShouldEqual, "application/xml")
+			log := Fetches{}
+			So(xml.Unmarshal(content, &log), ShouldBeNil)
+			So(log.Meta, ShouldResemble, fetches.Meta)
+			So(log.DeadLetters, ShouldResemble, fetches.DeadLetters)
+		})
+
+		Convey("The JSON log has the same fields, with the version of its schema", func() {
+			content, contType, err := marshalLog(fetches, "json")
+			So(err, ShouldBeNil)
+			So(contType, ShouldEqual, "application/json")
+			log := jsonLog{Fetches: &Fetches{}}
+			So(json.Unmarshal(content, &log), ShouldBeNil)
+			So(log.Version, ShouldEqual, jsonLogVersion)
+			So(log.Fetches, ShouldResemble, fetches)
+			So(string(content), ShouldContainSubstring, `"final_link": "http://example.com/feed?a=1&b=2"`)
+		})
+
+		Convey("The JSON Lines log has a record per line, the meta information being the last one", func() {
+			content, contType, err := marshalLog(fetches, "jsonl")
+			So(err, ShouldBeNil)
+			So(contType, ShouldEqual, "application/x-ndjson")
+			var records []string
+			scanner := bufio.NewScanner(bytes.NewReader(content))
+			for scanner.Scan() {
+				line := jsonLine{}
+				So(json.Unmarshal(scanner.Bytes(), &line), ShouldBeNil)
+				So(line.Version, ShouldEqual, jsonLogVersion)
+				records = append(records, line.Record)
+			}
+			So(records, ShouldResemble, []string{"fetch", "error", "unattempted", "dead_letter", "meta"})
+
+			fetchLine := Fetch{}
+			So(json.Unmarshal(bytes.SplitN(content, []byte("\n"), 2)[0], &fetchLine), ShouldBeNil)
+			So(&fetchLine, ShouldResemble, fetch)
+			meta := Meta{}
+			So(json.Unmarshal(bytes.Split(bytes.TrimSpace(content), []byte("\n"))[4], &meta), ShouldBeNil)
+			So(&meta, ShouldResemble, fetches.Meta)
+		})
+
+		Convey("The JSON logs follow their schema, even without errors", func() {
+			fetches.Meta.Report.Errors = 0
+			schema := map[string]interface{}{}
+			schemaBody, err := ioutil.ReadFile("docs/fetches.schema.json")
+			So(err, ShouldBeNil)
+			So(json.Unmarshal(schemaBody, &schema), ShouldBeNil)
+			defs := schema["$defs"].(map[string]interface{})
+
+			content, _, err := marshalLog(fetches, "json")
+			So(err, ShouldBeNil)
+			var log interface{}
+			So(json.Unmarshal(content, &log), ShouldBeNil)
+			So(schemaViolations(schema, defs, log, "log"), ShouldBeEmpty)
+
+			content, _, err = marshalLog(fetches, "jsonl")
+			So(err, ShouldBeNil)
+			for _, line := range bytes.Split(bytes.TrimSpace(content), []byte("\n")) {
+				record := map[string]interface{}{}
+				So(json.Unmarshal(line, &record), ShouldBeNil)
+				kind, _ := record["record"].(string)
+				So(defs, ShouldContainKey, kind)
+				So(schemaViolations(defs[kind], defs, record, kind), ShouldBeEmpty)
+			}
+		})
+
+		Convey("Unknown log formats are rejected", func() {
+			So(validLogFormat("jsonl"), ShouldBeTrue)
+			So(validLogFormat("yaml"), ShouldBeFalse)
+			_, _, err := marshalLog(fetches, "yaml")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+// schemaViolations returns the violations by the value of the required properties and of the types of the JSON schema,
+// whose references are resolved from its definitions. The other keywords of the schema are not checked.
+func schemaViolations(schema interface{}, defs map[string]interface{}, value interface{}, path string) []string {
+	rules := schema.(map[string]interface{})
+	if ref, ok := rules["$ref"].(string); ok {
+		return schemaViolations(defs[strings.TrimPrefix(ref, "#/$defs/")], defs, value, path)
+	}
+	var violations []string
+	switch rules["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s is not an object", path)}
+		}
+		required, _ := rules["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				violations = append(violations, fmt.Sprintf("%s.%s is missing", path, name))
+			}
+		}
+		properties, _ := rules["properties"].(map[string]interface{})
+		for name, property := range properties {
+			if propValue, ok := object[name]; ok {
+				violations = append(violations, schemaViolations(property, defs, propValue, path+"."+name)...)
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s is not an array", path)}
+		}
+		for i, item := range array {
+			violations = append(violations, schemaViolations(rules["items"], defs, item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case "string", "boolean", "integer", "number":
+		valid := false
+		switch value.(type) {
+		case string:
+			valid = rules["type"] == "string"
+		case bool:
+			valid = rules["type"] == "boolean"
+		case float64:
+			valid = rules["type"] == "number" || value.(float64) == float64(int64(value.(float64)))
+		}
+		if !valid {
+			violations = append(violations, fmt.Sprintf("%s is not of type %s", path, rules["type"]))
+		}
+	}
+	return violations
+}
@@ -2,7 +2,11 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"github.com/op/go-logging"
+	"os"
+	"os/signal"
 	"sync"
 	"time"
 )
@@ -12,25 +16,135 @@ var testGofetch = false
 
 var log = logging.MustGetLogger("gofetch")
 
+// RunResult stores the result of a run, which distinguishes the fatal error which aborted it from the failures of single URLs.
+type RunResult struct {
+	Fatal   error   // Stores the error which aborted the run, nil if all the URLs were processed.
+	Report  *Report // Stores the report of the processed URLs, including their failures, nil if the log could not be written.
+	LogPath string  // Stores the path of the log of the run, empty if it could not be written.
+}
+
+// fetchRun stores what a run writes to its log, so that a partial log can be written when the run is aborted.
+type fetchRun struct {
+	store   Storage          // Stores the storage of the content, the indexes and the log.
+	start   time.Time        // Stores the start time of the run.
+	logChan chan *Fetch      // Stores all the fetch logs as a result of the overall fetch.
+	errChan chan *FetchError // Stores all the fetch errors.
+	fatal   chan error       // Stores the first fatal error of the go routines, e.g. a panic.
+
+	checkpoint  *Checkpointer  // Stores the checkpointer which collects the logs and the errors, nil if the run is aborted before fetching.
+	unattempted []*Unattempted // Stores the URLs which were never attempted because the run was interrupted.
+	deadLetters *DeadLetters   // Stores the fetches which could not be stored.
+	workers     sync.WaitGroup // Counts the fetchers and the writers, which return once the scheduler and the s3chan are closed.
+}
+
 func main() {
-	mainStart := time.Now()
+	if result := Run(); result.Fatal != nil {
+		os.Exit(1)
+	}
+}
+
+// Run runs gofetch from the environment and returns its result. Once the storage is available, the log of the run is always
+// written, and is partial if the run is aborted by a fatal error.
+func Run() *RunResult {
+	result := &RunResult{}
+	run := &fetchRun{start: time.Now(), fatal: make(chan error, 1), deadLetters: &DeadLetters{}}
 	ConfigureLogger()
-	CheckEnvVars()
+	if result.Fatal = CheckEnvVars(); result.Fatal != nil {
+		log.Critical("Aborting gofetch: %s.", result.Fatal)
+		return result
+	}
 	log.Info("Starting gofetch.")
-	config := ConfigFromS3()
+	if run.store, result.Fatal = StorageFromOS(); result.Fatal != nil {
+		log.Critical("Aborting gofetch: %s.", result.Fatal)
+		return result
+	}
+
+	result.Fatal = run.fetch()
+	fetchDuration := time.Now().Sub(run.start)
+	var fetches []*Fetch
+	var fetchErrors []*FetchError
+	if run.checkpoint != nil {
+		run.checkpoint.Stop()
+		fetches, fetchErrors = run.checkpoint.Results()
+	}
+	// Write the log completion file to the storage.
+	report, logErr := LogFetches(run.store, fetches, fetchErrors, run.unattempted, run.deadLetters.List(), &fetchDuration, result.Fatal)
+	if logErr != nil {
+		log.Critical("Could not write the log of the run: %s.", logErr)
+	} else {
+		result.Report, result.LogPath = report, logFilePath()
+	}
+	if run.checkpoint != nil {
+		run.finishCheckpoint(result.Fatal == nil && logErr == nil)
+	}
+	switch {
+	case result.Fatal != nil:
+		log.Critical("Aborted gofetch after %s: %s.", fetchDuration, result.Fatal)
+	case logErr == nil && report.Errors+report.DeadLetters > 0:
+		log.Warning("Completed gofetch in %s, with %d failed URLs of %d.", fetchDuration, report.Errors+report.DeadLetters, report.Total)
+	default:
+		log.Info("Successfully completed gofetch in %s.", fetchDuration)
+	}
+	return result
+}
+
+// fetch fetches and stores the URLs of the configuration file, and returns the fatal error which aborted the run, if any.
+// The logs and the errors of the URLs are left in the channels of the run.
+func (run *fetchRun) fetch() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	store := run.store
+	config, err := ConfigFromStorage(store)
+	if err != nil {
+		return err
+	}
 
 	if len(config.Urls) == 0 {
-		panic("No URLs found in the configuration file.")
+		return fmt.Errorf("no URLs found in the configuration file")
+	}
+
+	if configErr := config.Validate(); configErr != nil {
+		return configErr
+	}
+
+	indexes, indexErr := IndexesFromConfig(config.Indexes)
+	if indexErr != nil {
+		return indexErr
 	}
 
 	throttleMap := ThrottleMap(config.Throttlers)
-	throttled := len(throttleMap)
+	defaultThrottler, err := DefaultThrottler(config.DefaultThrottle)
+	if err != nil {
+		return err
+	}
 	concWriters := ConcurrentS3Writes()
-	concFetches := ConcurrentFetches(throttled)
-	fetchOffset := FetchOffset()
-	fetchLimit := FetchLimit()
+	concFetches := ConcurrentFetches()
+	fetchOffset, err := FetchOffset()
+	if err != nil {
+		return err
+	}
+	fetchLimit, err := FetchLimit()
+	if err != nil {
+		return err
+	}
+	fetchDeadline := FetchDeadline()
+
+	// ctx cancels the fetches and the writes at the deadline of the run, if any.
+	ctx, cancel := context.WithCancel(context.Background())
+	runDeadline := RunDeadline()
+	if runDeadline > 0 {
+		log.Notice("Running with a deadline of %s.", runDeadline)
+		ctx, cancel = context.WithDeadline(context.Background(), run.start.Add(runDeadline))
+	}
+	defer cancel()
 
 	// Checking configuration file URLs to avoid over allocating memory.
+	if fetchOffset > len(config.Urls) {
+		return fmt.Errorf("FETCH_OFFSET %d is beyond the %d URLs of the configuration file", fetchOffset, len(config.Urls))
+	}
 	actualLimit := fetchOffset + fetchLimit
 	if actualLimit > len(config.Urls) {
 		log.Notice("Forcing fetching limit to %d (instead of %d).", len(config.Urls), actualLimit)
@@ -42,47 +156,137 @@ func main() {
 
 	// s3chan stores up to 100 buffered HttpResponses.
 	s3chan := make(chan *HTTPFetch, 100)
-	// fetchChan stores the up to X concurrent scrapes, allows to block when we've reached capacity.
-	fetchChan := make(chan *URLInfo, concFetches)
+	// scheduler hands the URLs to fetch to the fetchers, as per the throttling of each host.
+	scheduler := NewHostScheduler(throttleMap, defaultThrottler)
+	// checkpoint resumes the run from its checkpoint, if any, and collects the logs and the errors.
+	if run.checkpoint, err = CheckpointFromStorage(store); err != nil {
+		return err
+	}
 	// logChan stores all the fetch logs as a result of the overall fetch.
-	logChan := make(chan *Fetch, fetchRange)
+	run.logChan = make(chan *Fetch, fetchRange)
 	// errChan stores all the fetch errors. It is as long as the logChan in case all fetches fail.
-	errChan := make(chan *FetchError, fetchRange)
+	run.errChan = make(chan *FetchError, fetchRange)
+	run.checkpoint.Start(run.logChan, run.errChan, run.guard)
 
 	// Using a wait group to make sure not to die prior to all URLs fetched.
 	var wg sync.WaitGroup
 
+	// Putting all URLs to fetch to the scheduler, as determined by the environment, except those processed before resuming.
+	resumed := 0
+	for i, urlI := range config.Urls[fetchOffset:actualLimit] {
+		urlI.position = fetchOffset + i
+		if run.checkpoint.Resume(urlI) {
+			resumed++
+			continue
+		}
+		wg.Add(1)
+		scheduler.Add(newFetchJob(urlI))
+	}
+	if resumed > 0 {
+		log.Notice("Skipping %d URLs processed before resuming the run.", resumed)
+	}
+	scheduler.LogPolicies()
+
+	// spooler spools the large response bodies to disk.
+	spooler := SpoolerFromOS()
+	// client sends all the requests, as configured.
+	client := NewHTTPClient(config.Client)
+	// robots caches the robots.txt file of each host.
+	robots := NewRobotsCache(client)
+	// leases ensure that each content is uploaded once, by a single writer.
+	leases, err := LeasesFromOS(store)
+	if err != nil {
+		return err
+	}
+
+	// signals stop the run gracefully. They are handled before the first fetch so that no fetch is lost.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, shutdownSignals...)
+	defer signal.Stop(signals)
+
 	ConfigureRuntime()
 	// Starting as many concurrent scrapers as requested.
 	for i := 0; i < concFetches; i++ {
-		go Fetcher(fetchChan, s3chan, errChan, throttleMap, &wg)
+		run.launch(func() {
+			Fetcher(ctx, client, spooler, store, run.start, fetchDeadline, scheduler, robots, s3chan, run.errChan, &wg)
+		})
 	}
-
-	// Putting all URLs to fetch to the fetch channel, as determined by the environment.
-	for _, urlI := range config.Urls[fetchOffset:fetchRange] {
-		wg.Add(1)
-		go func(urlI *URLInfo) {
-			fetchChan <- urlI
-		}(urlI)
-	}
-	// The fetchChan is closed after everything has been processed because failure to process
-	// a fetch will add it to the channel again.
+	// The scheduler is closed after everything has been processed because failed attempts
+	// are added to the scheduler again.
 
 	// Starting the S3 processor.
+	writer := &StorageWriter{store: store, leases: leases, encoding: config.Compression.Encoding, indexes: indexes, retry: StorageRetryPolicy(),
+		queueSize: StorageRetryQueue(), logChan: run.logChan, errChan: run.errChan, deadLetters: run.deadLetters}
 	for i := 0; i < concWriters; i++ {
-		go ProcessResponses(s3chan, logChan, config.Indexes, &wg)
+		run.launch(func() { writer.ProcessResponses(ctx, s3chan, &wg) })
 	}
 
-	// Wait for completion of both fetching and writing content to S3.
-	wg.Wait()
+	// Wait for completion of both fetching and writing content to S3, unless a go routine fails, or the run is interrupted or cut off.
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	var stopped error
+	select {
+	case <-done:
+	case err := <-run.fatal:
+		// The go routines are left running, and the URLs they process are missing from the partial log.
+		return err
+	case sig := <-signals:
+		interrupted := run.interrupt(sig, signals, scheduler, &wg, done)
+		if stopped = interrupted; !interrupted.Drained {
+			return stopped
+		}
+	case <-ctx.Done():
+		cutOff := run.cutOff(runDeadline, signals, scheduler, &wg, done)
+		if stopped = cutOff; !cutOff.Drained {
+			return stopped
+		}
+	}
 
-	close(fetchChan)
+	scheduler.Close()
 	close(s3chan)
-	close(logChan)
-	close(errChan)
+	// The fetchers and the writers are done with the URLs, so they return at once.
+	run.workers.Wait()
+	close(run.logChan)
+	close(run.errChan)
+	return stopped
+}
+
+// finishCheckpoint deletes the checkpoint of the run once it is complete and logged, or else saves it so that the run can be resumed.
+func (run *fetchRun) finishCheckpoint(complete bool) {
+	if complete {
+		if err := run.checkpoint.Delete(); err != nil {
+			log.Warning("Could not delete the checkpoint of the run: %s.", err)
+		}
+		return
+	}
+	if err := run.checkpoint.Save(); err != nil {
+		log.Error("Could not save the checkpoint of the run: %s.", err)
+	}
+}
+
+// launch starts a go routine of the run, counted in the workers of the run, and turns its panic into the fatal error of the run.
+func (run *fetchRun) launch(routine func()) {
+	run.workers.Add(1)
+	run.guard(func() {
+		defer run.workers.Done()
+		routine()
+	})
+}
 
-	fetchDuration := time.Now().Sub(mainStart)
-	// Write the log completion file to S3.
-	LogFetches(logChan, errChan, &fetchDuration)
-	log.Info("Successfully completed gofetch in %s.", fetchDuration)
+// guard starts a go routine of the run, and turns its panic into the fatal error of the run.
+func (run *fetchRun) guard(routine func()) {
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				select {
+				case run.fatal <- fmt.Errorf("panic: %v", r):
+				default: // The run is already aborted.
+				}
+			}
+		}()
+		routine()
+	}()
 }
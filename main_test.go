@@ -1,21 +1,102 @@
 package main
 
 import (
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
+	"github.com/Sparrho/gofetch/content"
 	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
-// TestGofetch tests all of GoFetch features with dummy datasets hosted on S3.
+// TestGofetch tests all of GoFetch features with dummy datasets served by a fake origin server and an in-memory storage.
 func TestGofetch(t *testing.T) {
 	testGofetch = true
+	// The fake origin server serves the test feeds as they would be served from S3, and counts the requests per path.
+	var requestsMu sync.Mutex
+	requests := make(map[string]int)
+	// requestCount returns the number of requests to the path so far.
+	requestCount := func(path string) int {
+		requestsMu.Lock()
+		defer requestsMu.Unlock()
+		return requests[path]
+	}
+	feeds := http.StripPrefix("/gofetch/test_data", http.FileServer(http.Dir("testdata")))
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsMu.Lock()
+		requests[r.URL.Path]++
+		count := requests[r.URL.Path]
+		requestsMu.Unlock()
+		switch {
+		case r.URL.Path == "/robots.txt":
+			fmt.Fprint(w, "User-agent: *\nDisallow: /gofetch/test_data/private/\nCrawl-delay: 0.001\n")
+			return
+		case strings.HasPrefix(r.URL.Path, "/gofetch/test_data/private/"):
+			fmt.Fprintf(w, "Private %s", r.URL.Path)
+			return
+		case r.URL.Path == "/gofetch/test_data/body/streamed.xml":
+			// The body is streamed without a Content-Length.
+			for i := 0; i < 32; i++ {
+				fmt.Fprint(w, strings.Repeat("s", 63)+"\n")
+				w.(http.Flusher).Flush()
+			}
+			return
+		case r.URL.Path == "/gofetch/test_data/body/declared.xml":
+			w.Header().Set("Content-Length", "2048")
+			fmt.Fprint(w, strings.Repeat("d", 2048))
+			return
+		case r.URL.Path == "/gofetch/test_data/body/truncated.xml":
+			// The connection is closed before the declared Content-Length.
+			w.Header().Set("Content-Length", "100")
+			fmt.Fprint(w, "Truncated")
+			return
+		case strings.HasPrefix(r.URL.Path, "/gofetch/test_data/shutdown/"):
+			if r.URL.Path == "/gofetch/test_data/shutdown/first.xml" {
+				// The run is interrupted while this fetch is in flight.
+				process, _ := os.FindProcess(os.Getpid())
+				process.Signal(os.Interrupt)
+				time.Sleep(50 * time.Millisecond)
+			}
+			fmt.Fprintf(w, "Shutdown %s", r.URL.Path)
+			return
+		case strings.HasPrefix(r.URL.Path, "/gofetch/test_data/deadline/"):
+			if r.URL.Path == "/gofetch/test_data/deadline/slow.xml" {
+				// The response is only sent after the deadlines, unless the request is cancelled first.
+				select {
+				case <-r.Context().Done():
+				case <-time.After(5 * time.Second):
+				}
+			}
+			fmt.Fprintf(w, "Deadline %s", r.URL.Path)
+			return
+		case strings.HasPrefix(r.URL.Path, "/gofetch/test_data/flaky/"):
+			// The flaky paths are unavailable for the first two requests.
+			if count <= 2 {
+				http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+			} else {
+				fmt.Fprintf(w, "Recovered %s", r.URL.Path)
+			}
+			return
+		}
+		feeds.ServeHTTP(w, r)
+	}))
+	defer origin.Close()
+	originURL, _ := url.Parse(origin.URL)
+
 	// Setting some environment variables.
-	testSettings := map[string]string{"MAX_CPUS": "1", "AWS_STORAGE_BUCKET_NAME": "example-bucket",
+	testSettings := map[string]string{"MAX_CPUS": "1", "STORAGE_BACKEND": "memory", "CONCURRENT_S3WRITERS": "4",
 		"LOG_LEVEL": "DEBUG", "AWS_CONFIG_FILE": "/gofetch/test_data/test_config_nominal.xml", "FETCH_ID": "1",
-		"FETCH_OFFSET": "0", "FETCH_LIMIT": "10"}
+		"FETCH_OFFSET": "0", "FETCH_LIMIT": "10", "CONTENT_LEASES": "storage"}
 	for env, val := range testSettings {
 		err := os.Setenv(env, val)
 		if err != nil {
@@ -23,36 +104,41 @@ func TestGofetch(t *testing.T) {
 		}
 		log.Debug("Set envvar %s to %s.", env, val)
 	}
+	defer os.Unsetenv("STORAGE_BACKEND")
+	defer os.Unsetenv("CONCURRENT_S3WRITERS")
+	defer os.Unsetenv("CONTENT_LEASES")
 
-	Convey("With dummy data, check that all output is nominal and reset S3 test folder", t, func() {
-		bucket := S3BucketFromOS()
+	store, _ := StorageFromOS()
+	store.(*MemoryStorage).Reset()
+	putTestConfig(store, "test_config_nominal.xml", originURL.Host)
+	putTestConfig(store, "test_config_empty.xml", originURL.Host)
+	putTestConfig(store, "test_config_unknown_index.xml", originURL.Host)
+	putTestConfig(store, "test_config_status.xml", originURL.Host)
+	putTestConfig(store, "test_config_robots.xml", originURL.Host)
+	putTestConfig(store, "test_config_body.xml", originURL.Host)
+	putTestConfig(store, "test_config_shutdown.xml", originURL.Host)
+	putTestConfig(store, "test_config_deadline.xml", originURL.Host)
+	putTestConfig(store, "test_config_invalid_duration.xml", originURL.Host)
 
+	Convey("With dummy data, check that all output is nominal", t, func() {
 		// Expectations
-		expChecksumPath := []string{"/gofetch/test_data/index/sha384_checksum/a6cd5b1ffba20c8789d770c3ed80263947c4f13510fb2d63cb1c96043e25f2b4f5b0b40f8f91c21606cec409cb376dfb",
-			"/gofetch/test_data/index/sha384_checksum/3c0edeebdfb207f6b233368a06bfd612e00a19afa9ea0468ecad85c9f245c1b5f9c5dff62408d4374fa975aaf3a87b64"}
+		apaChecksum := testChecksum("testdata/feeds/apa-journals-pas.xml")
+		dydanChecksum := testChecksum("testdata/feeds/dydan1.xml")
 
-		expContentPath := []string{"/gofetch/test_data/sha384_content/3c0edeebdfb207f6b233368a06bfd612e00a19afa9ea0468ecad85c9f245c1b5f9c5dff62408d4374fa975aaf3a87b64",
-			"/gofetch/test_data/sha384_content/a6cd5b1ffba20c8789d770c3ed80263947c4f13510fb2d63cb1c96043e25f2b4f5b0b40f8f91c21606cec409cb376dfb"}
+		expChecksumPath := []string{"/gofetch/test_data/index/sha384_checksum/" + apaChecksum + "/",
+			"/gofetch/test_data/index/sha384_checksum/" + dydanChecksum + "/"}
 
-		expIndexLinks := []string{"http://example-bucket.s3.amazonaws.com/gofetch/test_data/feeds/apa-journals-pas.xml",
-			"http://example-bucket.s3.amazonaws.com/gofetch/test_data/feeds/dydan1.xml"}
+		expContentPath := []string{"/gofetch/test_data/sha384_content/" + dydanChecksum,
+			"/gofetch/test_data/sha384_content/" + apaChecksum}
 
-		logFile := logFilePath()
+		expIndexLinks := []string{origin.URL + "/gofetch/test_data/feeds/apa-journals-pas.xml",
+			origin.URL + "/gofetch/test_data/feeds/dydan1.xml"}
 
-		defer func() {
-			// Let's delete the test data as a defer of this test.
-			for pi := range expChecksumPath {
-				bucket.Del(expChecksumPath[pi])
-			}
-			for pi := range expContentPath {
-				bucket.Del(expContentPath[pi])
-			}
-			bucket.Del(logFile)
-		}()
+		logFile := logFilePath()
 
-		main()
+		So(Run().Fatal, ShouldBeNil)
 		// Let's grab the log file.
-		logBody, notFoundErr := bucket.Get(logFile)
+		logBody, notFoundErr := store.Get(logFile)
 		if notFoundErr != nil {
 			panic(notFoundErr)
 		}
@@ -63,6 +149,7 @@ func TestGofetch(t *testing.T) {
 			panic(xmlErr)
 		}
 
+		So(log.Meta.Result.Status, ShouldEqual, "partial")
 		So(log.Meta.Report.Novel, ShouldEqual, 2)
 		So(log.Meta.Report.Errors, ShouldEqual, 1)
 		So(log.Meta.Report.Total, ShouldEqual, 4)
@@ -73,13 +160,35 @@ func TestGofetch(t *testing.T) {
 		for fid := range log.Fetch {
 			fetch := log.Fetch[fid]
 			So(fetch.Parser, ShouldEqual, "RawArticle")
-			So(fetch.ChecksumIndex.Bucket, ShouldEqual, S3BucketFromOS().Name)
-			So(fetch.ChecksumIndex.Path, ShouldBeIn, expChecksumPath)
-			So(fetch.S3Content.Bucket, ShouldEqual, S3BucketFromOS().Name)
+			So(fetch.Status, ShouldEqual, 200)
+			So(fetch.FinalLink, ShouldBeIn, expIndexLinks)
+			So(fetch.Request.Method, ShouldEqual, "GET")
+			So(fetch.ChecksumIndex.Bucket, ShouldEqual, store.Name())
+			checksumPath := fetch.ChecksumIndex.Path[:strings.LastIndex(fetch.ChecksumIndex.Path, "/")+1]
+			So(checksumPath, ShouldBeIn, expChecksumPath)
+			So(fetch.S3Content.Bucket, ShouldEqual, store.Name())
 			So(fetch.S3Content.Path, ShouldBeIn, expContentPath)
 
+			// Let's check that the content is stored as is.
+			content, notFoundErr := store.Get(fetch.S3Content.Path)
+			So(notFoundErr, ShouldBeNil)
+			So(testChecksum(content), ShouldEqual, fetch.S3Content.Path[strings.LastIndex(fetch.S3Content.Path, "/")+1:])
+			So(store.(*MemoryStorage).ContentType(fetch.S3Content.Path), ShouldEqual, "text/xml; charset=utf-8")
+
+			// Let's check the metadata stored next to the content.
+			So(fetch.S3Metadata.Path, ShouldEqual, fetch.S3Content.Path+".meta")
+			metadataBody, notFoundErr := store.Get(fetch.S3Metadata.Path)
+			So(notFoundErr, ShouldBeNil)
+			metadata := ContentMetadata{}
+			So(xml.Unmarshal(metadataBody, &metadata), ShouldBeNil)
+			So(metadata.ContentType, ShouldEqual, "text/xml; charset=utf-8")
+			So(metadata.Status, ShouldEqual, 200)
+			So(metadata.FinalLink, ShouldBeIn, expIndexLinks)
+			So(metadata.FetchTime.IsZero(), ShouldBeFalse)
+			So(metadata.Headers, ShouldNotBeEmpty)
+
 			// Let's load the index for this item and check its validity.
-			idxBody, notFoundErr := bucket.Get(fetch.ChecksumIndex.Path)
+			idxBody, notFoundErr := ReadChecksumIndex(store, checksumPath)
 			if notFoundErr != nil {
 				panic(notFoundErr)
 			}
@@ -99,15 +208,410 @@ func TestGofetch(t *testing.T) {
 
 		}
 
+		// The duplicated URL must be added to the same index, even though it is processed concurrently.
+		apaIdx, _ := ReadChecksumIndex(store, expChecksumPath[0])
+		So(strings.Count(string(apaIdx), "\n"), ShouldEqual, 2)
+		dydanIdx, _ := ReadChecksumIndex(store, expChecksumPath[1])
+		So(strings.Count(string(dydanIdx), "\n"), ShouldEqual, 1)
+		// The leases of the uploads are released.
+		leases, _ := store.List("/gofetch/test_data/lease/")
+		So(leases, ShouldBeEmpty)
+
+		// The by link index must have one line per fetch of the link.
+		apaByLink, notFoundErr := ReadIndex(store, "/gofetch/test_data/index/by_link/"+linkChecksum(expIndexLinks[0])+"/")
+		So(notFoundErr, ShouldBeNil)
+		apaLines := strings.Split(strings.TrimSuffix(string(apaByLink), "\n"), "\n")
+		So(len(apaLines), ShouldEqual, 2)
+		for _, line := range apaLines {
+			rows := strings.Split(line, "\t")
+			So(len(rows), ShouldEqual, 4)
+			So(rows[1], ShouldEqual, apaChecksum)
+			So(rows[2], ShouldEqual, "200")
+		}
+
+		// The novel by parser index must only list the novel content.
+		novelIdx, notFoundErr := ReadIndex(store, "/gofetch/test_data/index/novel_by_parser/RawArticle/"+time.Now().UTC().Format("2006-01-02")+"/")
+		So(notFoundErr, ShouldBeNil)
+		novelLines := strings.Split(strings.TrimSuffix(string(novelIdx), "\n"), "\n")
+		So(len(novelLines), ShouldEqual, 2)
+		for _, line := range novelLines {
+			rows := strings.Split(line, "\t")
+			So(len(rows), ShouldEqual, 3)
+			So(rows[0], ShouldBeIn, expContentPath)
+			So(rows[2], ShouldStartWith, "<feed id=")
+		}
+	})
+
+	Convey("With the same dummy data fetched again, check that the content is unchanged", t, func() {
+		apaChecksum := testChecksum("testdata/feeds/apa-journals-pas.xml")
+
+		So(Run().Fatal, ShouldBeNil)
+		logBody, notFoundErr := store.Get(logFilePath())
+		So(notFoundErr, ShouldBeNil)
+		log := Fetches{}
+		So(xml.Unmarshal(logBody, &log), ShouldBeNil)
+
+		So(log.Meta.Report.Novel, ShouldEqual, 0)
+		So(log.Meta.Report.Unchanged, ShouldEqual, 3)
+		So(log.Meta.Report.Errors, ShouldEqual, 1)
+		So(log.Meta.Report.Total, ShouldEqual, 4)
+		for _, fetch := range log.Fetch {
+			So(fetch.Novel, ShouldBeFalse)
+			So(fetch.Unchanged, ShouldBeTrue)
+		}
+
+		// The canonical index is not updated, but the by link index records the unchanged fetches.
+		apaIdx, _ := ReadChecksumIndex(store, "/gofetch/test_data/index/sha384_checksum/"+apaChecksum+"/")
+		So(strings.Count(string(apaIdx), "\n"), ShouldEqual, 2)
+		apaByLink, _ := ReadIndex(store, "/gofetch/test_data/index/by_link/"+linkChecksum(origin.URL+"/gofetch/test_data/feeds/apa-journals-pas.xml")+"/")
+		apaLines := strings.Split(strings.TrimSuffix(string(apaByLink), "\n"), "\n")
+		So(len(apaLines), ShouldEqual, 4)
+		for _, line := range apaLines[2:] {
+			rows := strings.Split(line, "\t")
+			So(rows[1], ShouldEqual, apaChecksum)
+			So(rows[2], ShouldEqual, "304")
+		}
+	})
+
+	Convey("With non-success statuses, check that the status policies are applied", t, func() {
+		os.Setenv("AWS_CONFIG_FILE", "/gofetch/test_data/test_config_status.xml")
+		defer os.Setenv("AWS_CONFIG_FILE", "/gofetch/test_data/test_config_nominal.xml")
+
+		So(Run().Fatal, ShouldBeNil)
+		logBody, notFoundErr := store.Get(logFilePath())
+		So(notFoundErr, ShouldBeNil)
+		log := Fetches{}
+		So(xml.Unmarshal(logBody, &log), ShouldBeNil)
+
+		// The skipped URL is not in the output log.
+		So(log.Meta.Report.Errors, ShouldEqual, 3)
+		So(log.Meta.Report.Total, ShouldEqual, 5)
+		for _, fetchErr := range log.FetchError {
+			switch fetchErr.Original {
+			case origin.URL + "/gofetch/test_data/flaky/unavailable.xml":
+				So(fetchErr.Status, ShouldEqual, 503)
+				So(fetchErr.Attempts, ShouldEqual, 2)
+				So(len(fetchErr.FailedAttempts), ShouldEqual, 2)
+			case origin.URL + "/gofetch/test_data/feeds/retried.xml":
+				So(fetchErr.Status, ShouldEqual, 404)
+				So(fetchErr.Attempts, ShouldEqual, 3)
+				So(len(fetchErr.FailedAttempts), ShouldEqual, 3)
+			default:
+				So(fetchErr.Original, ShouldEqual, origin.URL+"/gofetch/test_data/feeds/missing.xml")
+				So(fetchErr.Status, ShouldEqual, 404)
+				So(fetchErr.Attempts, ShouldEqual, 1)
+			}
+		}
+		So(requestCount("/gofetch/test_data/feeds/retried.xml"), ShouldEqual, 3)
+		So(requestCount("/gofetch/test_data/feeds/missing.xml"), ShouldEqual, 1)
+
+		So(len(log.Fetch), ShouldEqual, 2)
+		for _, fetch := range log.Fetch {
+			if fetch.FinalLink == origin.URL+"/gofetch/test_data/flaky/recovered.xml" {
+				// The recovered URL is stored after two failed attempts.
+				So(fetch.Status, ShouldEqual, 200)
+				So(fetch.Attempts, ShouldEqual, 3)
+				So(len(fetch.FailedAttempts), ShouldEqual, 2)
+				So(fetch.FailedAttempts[0].Status, ShouldEqual, 503)
+				continue
+			}
+			// The stored URL is stored and logged with its status, final link and headers.
+			So(fetch.Status, ShouldEqual, 404)
+			So(fetch.FinalLink, ShouldEqual, origin.URL+"/gofetch/test_data/feeds/stored.xml")
+			So(fetch.Attempts, ShouldEqual, 1)
+			So(fetch.Headers, ShouldNotBeEmpty)
+			So(fetch.Headers[0].Name, ShouldEqual, "Content-Type")
+			_, notFoundErr = store.Get(fetch.S3Content.Path)
+			So(notFoundErr, ShouldBeNil)
+		}
+	})
+
+	Convey("With URLs disallowed by robots.txt, check that they are not fetched unless overridden", t, func() {
+		os.Setenv("AWS_CONFIG_FILE", "/gofetch/test_data/test_config_robots.xml")
+		defer os.Setenv("AWS_CONFIG_FILE", "/gofetch/test_data/test_config_nominal.xml")
+		robotsRequests := requestCount("/robots.txt")
+
+		So(Run().Fatal, ShouldBeNil)
+		logBody, notFoundErr := store.Get(logFilePath())
+		So(notFoundErr, ShouldBeNil)
+		log := Fetches{}
+		So(xml.Unmarshal(logBody, &log), ShouldBeNil)
+
+		So(log.Meta.Report.Errors, ShouldEqual, 2)
+		So(log.Meta.Report.Total, ShouldEqual, 4)
+		for _, fetchErr := range log.FetchError {
+			So(fetchErr.Original, ShouldStartWith, origin.URL+"/gofetch/test_data/private/")
+			So(fetchErr.Reason, ShouldEqual, "robots")
+			So(fetchErr.Attempts, ShouldEqual, 0)
+		}
+		So(requestCount("/gofetch/test_data/private/disallowed.xml"), ShouldEqual, 0)
+		So(requestCount("/gofetch/test_data/private/also_disallowed.xml"), ShouldEqual, 0)
+		// The robots.txt file is only fetched once per run.
+		So(requestCount("/robots.txt")-robotsRequests, ShouldEqual, 1)
+
+		So(len(log.Fetch), ShouldEqual, 2)
+		for _, fetch := range log.Fetch {
+			if fetch.FinalLink == origin.URL+"/gofetch/test_data/private/agreed.xml" {
+				So(fetch.Status, ShouldEqual, 200)
+				continue
+			}
+			// The other URL was fetched by the previous runs.
+			So(fetch.Unchanged, ShouldBeTrue)
+		}
+		So(requestCount("/gofetch/test_data/private/agreed.xml"), ShouldEqual, 1)
+	})
+
+	Convey("With oversized and truncated bodies, check that they are logged as errors", t, func() {
+		os.Setenv("AWS_CONFIG_FILE", "/gofetch/test_data/test_config_body.xml")
+		defer os.Setenv("AWS_CONFIG_FILE", "/gofetch/test_data/test_config_nominal.xml")
+		// The bodies larger than 1000 bytes are spooled to disk.
+		spoolDir, err := ioutil.TempDir("", "gofetch-spool-")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(spoolDir)
+		os.Setenv("SPOOL_THRESHOLD", "1000")
+		os.Setenv("SPOOL_PATH", spoolDir)
+		defer os.Unsetenv("SPOOL_THRESHOLD")
+		defer os.Unsetenv("SPOOL_PATH")
+
+		So(Run().Fatal, ShouldBeNil)
+		logBody, notFoundErr := store.Get(logFilePath())
+		So(notFoundErr, ShouldBeNil)
+		log := Fetches{}
+		So(xml.Unmarshal(logBody, &log), ShouldBeNil)
+
+		So(log.Meta.Report.Errors, ShouldEqual, 3)
+		So(log.Meta.Report.Total, ShouldEqual, 4)
+		for _, fetchErr := range log.FetchError {
+			switch fetchErr.Original {
+			case origin.URL + "/gofetch/test_data/body/truncated.xml":
+				// A truncated body is retried as a transient network error.
+				So(fetchErr.Reason, ShouldEqual, "truncated")
+				So(fetchErr.Attempts, ShouldEqual, 2)
+			default:
+				So(fetchErr.Reason, ShouldEqual, "oversized")
+				So(fetchErr.Attempts, ShouldEqual, 1)
+			}
+		}
+
+		So(len(log.Fetch), ShouldEqual, 1)
+		So(log.Fetch[0].Encoding, ShouldEqual, "gzip")
+		stored, notFoundErr := store.Get(log.Fetch[0].S3Content.Path)
+		So(notFoundErr, ShouldBeNil)
+		So(len(stored), ShouldBeLessThan, 2048)
+		decoded, err := content.Read(store, log.Fetch[0].S3Content.Path)
+		So(err, ShouldBeNil)
+		So(len(decoded), ShouldEqual, 2048)
+		So(testChecksum(decoded), ShouldEqual, log.Fetch[0].S3Content.Path[strings.LastIndex(log.Fetch[0].S3Content.Path, "/")+1:])
+		// The spool files are removed once the content is stored.
+		spooled, _ := ioutil.ReadDir(spoolDir)
+		So(spooled, ShouldBeEmpty)
+	})
+
+	Convey("With a signal during the run, check that the fetches in flight are stored and the log is interrupted", t, func() {
+		os.Setenv("AWS_CONFIG_FILE", "/gofetch/test_data/test_config_shutdown.xml")
+		defer os.Setenv("AWS_CONFIG_FILE", "/gofetch/test_data/test_config_nominal.xml")
+
+		result := Run()
+		So(result.Fatal, ShouldHaveSameTypeAs, &InterruptError{})
+		So(result.Fatal.(*InterruptError).Drained, ShouldBeTrue)
+		logBody, notFoundErr := store.Get(result.LogPath)
+		So(notFoundErr, ShouldBeNil)
+		log := Fetches{}
+		So(xml.Unmarshal(logBody, &log), ShouldBeNil)
+
+		So(log.Meta.Result.Status, ShouldEqual, "interrupted")
+		So(log.Meta.Report.Total, ShouldEqual, 1)
+		So(log.Meta.Report.Unattempted, ShouldEqual, 2)
+		So(len(log.Fetch), ShouldEqual, 1)
+		So(log.Fetch[0].FinalLink, ShouldEqual, origin.URL+"/gofetch/test_data/shutdown/first.xml")
+		_, notFoundErr = store.Get(log.Fetch[0].S3Content.Path)
+		So(notFoundErr, ShouldBeNil)
+		So(len(log.Unattempted), ShouldEqual, 2)
+		for _, unattempted := range log.Unattempted {
+			So(unattempted.Original, ShouldBeIn, []string{origin.URL + "/gofetch/test_data/shutdown/second.xml", origin.URL + "/gofetch/test_data/shutdown/third.xml"})
+		}
+		So(requestCount("/gofetch/test_data/shutdown/second.xml"), ShouldEqual, 0)
+		// The checkpoint of the interrupted run is kept.
+		exists, _ := store.Exists(checkpointPath())
+		So(exists, ShouldBeTrue)
+	})
+
+	Convey("With the interrupted run restarted, check that it resumes from its checkpoint", t, func() {
+		os.Setenv("AWS_CONFIG_FILE", "/gofetch/test_data/test_config_shutdown.xml")
+		defer os.Setenv("AWS_CONFIG_FILE", "/gofetch/test_data/test_config_nominal.xml")
+
+		So(Run().Fatal, ShouldBeNil)
+		logBody, notFoundErr := store.Get(logFilePath())
+		So(notFoundErr, ShouldBeNil)
+		log := Fetches{}
+		So(xml.Unmarshal(logBody, &log), ShouldBeNil)
+
+		// The log of the interrupted run is merged into the final log.
+		So(log.Meta.Result.Status, ShouldEqual, "completed")
+		So(log.Meta.Report.Total, ShouldEqual, 3)
+		So(log.Meta.Report.Unattempted, ShouldEqual, 0)
+		So(len(log.Fetch), ShouldEqual, 3)
+		So(log.Fetch[0].FinalLink, ShouldEqual, origin.URL+"/gofetch/test_data/shutdown/first.xml")
+		So(requestCount("/gofetch/test_data/shutdown/first.xml"), ShouldEqual, 1)
+		So(requestCount("/gofetch/test_data/shutdown/second.xml"), ShouldEqual, 1)
+		// The checkpoint of the complete run is deleted.
+		exists, _ := store.Exists(checkpointPath())
+		So(exists, ShouldBeFalse)
+	})
+
+	Convey("With a fetch deadline, check that the slow fetch fails without holding up the others", t, func() {
+		os.Setenv("AWS_CONFIG_FILE", "/gofetch/test_data/test_config_deadline.xml")
+		defer os.Setenv("AWS_CONFIG_FILE", "/gofetch/test_data/test_config_nominal.xml")
+		os.Setenv("FETCH_DEADLINE", "1")
+		defer os.Unsetenv("FETCH_DEADLINE")
+
+		So(Run().Fatal, ShouldBeNil)
+		logBody, notFoundErr := store.Get(logFilePath())
+		So(notFoundErr, ShouldBeNil)
+		log := Fetches{}
+		So(xml.Unmarshal(logBody, &log), ShouldBeNil)
+		So(log.Meta.Result.Status, ShouldEqual, "partial")
+		So(len(log.FetchError), ShouldEqual, 1)
+		So(log.FetchError[0].Original, ShouldEqual, origin.URL+"/gofetch/test_data/deadline/slow.xml")
+		So(log.FetchError[0].Reason, ShouldEqual, "deadline")
+		// The deadline passed during the first attempt, so there is no retry.
+		So(log.FetchError[0].Attempts, ShouldEqual, 1)
+		So(len(log.Fetch), ShouldEqual, 1)
+		So(log.Fetch[0].FinalLink, ShouldEqual, origin.URL+"/gofetch/test_data/deadline/fast.xml")
+	})
+
+	Convey("With a run deadline, check that the run is cut off and reports the URLs cut off", t, func() {
+		os.Setenv("AWS_CONFIG_FILE", "/gofetch/test_data/test_config_deadline.xml")
+		defer os.Setenv("AWS_CONFIG_FILE", "/gofetch/test_data/test_config_nominal.xml")
+		os.Setenv("RUN_DEADLINE", "1")
+		defer os.Unsetenv("RUN_DEADLINE")
+		requestsMu.Lock()
+		requests["/gofetch/test_data/deadline/fast.xml"] = 0
+		requestsMu.Unlock()
+
+		result := Run()
+		So(result.Fatal, ShouldHaveSameTypeAs, &DeadlineError{})
+		So(result.Fatal.(*DeadlineError).Drained, ShouldBeTrue)
+		logBody, notFoundErr := store.Get(logFilePath())
+		So(notFoundErr, ShouldBeNil)
+		log := Fetches{}
+		So(xml.Unmarshal(logBody, &log), ShouldBeNil)
+		So(log.Meta.Result.Status, ShouldEqual, "cutoff")
+		So(log.Meta.Result.Fatal, ShouldEqual, result.Fatal.Error())
+		// The slow fetch in flight is cancelled, and the fast one is never attempted.
+		So(len(log.Fetch), ShouldEqual, 0)
+		So(len(log.FetchError), ShouldEqual, 1)
+		So(log.FetchError[0].Original, ShouldEqual, origin.URL+"/gofetch/test_data/deadline/slow.xml")
+		So(log.FetchError[0].Reason, ShouldEqual, "cutoff")
+		So(len(log.Unattempted), ShouldEqual, 1)
+		So(log.Unattempted[0].Original, ShouldEqual, origin.URL+"/gofetch/test_data/deadline/fast.xml")
+		So(requestCount("/gofetch/test_data/deadline/fast.xml"), ShouldEqual, 0)
 	})
 
 	Convey("With empty config file", t, func() {
 		os.Setenv("AWS_CONFIG_FILE", "/gofetch/test_data/test_config_empty.xml")
-		So(main, ShouldPanic)
+		result := Run()
+		So(result.Fatal, ShouldNotBeNil)
+		// The log of the aborted run is written anyway.
+		So(result.LogPath, ShouldEqual, logFilePath())
+		logBody, notFoundErr := store.Get(result.LogPath)
+		So(notFoundErr, ShouldBeNil)
+		log := Fetches{}
+		So(xml.Unmarshal(logBody, &log), ShouldBeNil)
+		So(log.Meta.Result.Status, ShouldEqual, "aborted")
+		So(log.Meta.Result.Fatal, ShouldEqual, result.Fatal.Error())
+		So(log.Meta.Report.Total, ShouldEqual, 0)
+	})
+
+	Convey("With the JSON Lines log format, check that the log of the aborted run is written in JSON Lines", t, func() {
+		os.Setenv("AWS_CONFIG_FILE", "/gofetch/test_data/test_config_empty.xml")
+		defer os.Setenv("AWS_CONFIG_FILE", "/gofetch/test_data/test_config_nominal.xml")
+		os.Setenv("LOG_FORMAT", "jsonl")
+		defer os.Unsetenv("LOG_FORMAT")
+
+		result := Run()
+		So(result.Fatal, ShouldNotBeNil)
+		So(result.LogPath, ShouldEndWith, ".jsonl")
+		logBody, notFoundErr := store.Get(result.LogPath)
+		So(notFoundErr, ShouldBeNil)
+		meta := struct {
+			jsonLine
+			Meta
+		}{}
+		So(json.Unmarshal(logBody, &meta), ShouldBeNil)
+		So(meta.Record, ShouldEqual, "meta")
+		So(meta.Result.Status, ShouldEqual, "aborted")
+	})
+
+	Convey("With an unknown log format, check that the run is aborted", t, func() {
+		os.Setenv("LOG_FORMAT", "yaml")
+		defer os.Unsetenv("LOG_FORMAT")
+		So(Run().Fatal, ShouldNotBeNil)
+	})
+
+	Convey("With an offset beyond the URLs of the config file, check that the run is aborted", t, func() {
+		os.Setenv("FETCH_OFFSET", "1000")
+		defer os.Setenv("FETCH_OFFSET", "0")
+		result := Run()
+		So(result.Fatal, ShouldNotBeNil)
+		So(result.Fatal.Error(), ShouldContainSubstring, "FETCH_OFFSET")
+	})
+
+	Convey("With a checkpoint interval which is not positive, check that the run is aborted with its log", t, func() {
+		os.Setenv("CHECKPOINT_INTERVAL", "-1")
+		defer os.Unsetenv("CHECKPOINT_INTERVAL")
+		result := Run()
+		So(result.Fatal, ShouldNotBeNil)
+		_, notFoundErr := store.Get(result.LogPath)
+		So(notFoundErr, ShouldBeNil)
+	})
+
+	Convey("With an unknown index in config file", t, func() {
+		os.Setenv("AWS_CONFIG_FILE", "/gofetch/test_data/test_config_unknown_index.xml")
+		So(Run().Fatal, ShouldNotBeNil)
 	})
 
 	Convey("With an invalid throttling duration in config file", t, func() {
 		os.Setenv("AWS_CONFIG_FILE", "/gofetch/test_data/test_config_invalid_duration.xml")
-		So(main, ShouldPanic)
+		result := Run()
+		So(result.Fatal, ShouldNotBeNil)
+		So(result.Fatal.Error(), ShouldContainSubstring, "invalid default throttle")
+	})
+
+	Convey("With an unknown storage backend", t, func() {
+		os.Setenv("STORAGE_BACKEND", "carrots")
+		defer os.Setenv("STORAGE_BACKEND", "memory")
+		result := Run()
+		So(result.Fatal, ShouldNotBeNil)
+		So(result.LogPath, ShouldBeEmpty)
 	})
 }
+
+// putTestConfig stores the provided test configuration file in the storage, pointing its links to the fake origin server.
+func putTestConfig(store Storage, name string, originHost string) {
+	config, err := ioutil.ReadFile(name)
+	if err != nil {
+		panic(err)
+	}
+	config = []byte(strings.Replace(string(config), "example.s3.amazonaws.com", originHost, -1))
+	if err := store.Put("/gofetch/test_data/"+name, config, "application/xml"); err != nil {
+		panic(err)
+	}
+}
+
+// testChecksum returns the hex encoded SHA384 checksum of the provided data, or of the file if a string is provided.
+func testChecksum(data interface{}) string {
+	var body []byte
+	switch data := data.(type) {
+	case string:
+		var err error
+		if body, err = ioutil.ReadFile(data); err != nil {
+			panic(err)
+		}
+	case []byte:
+		body = data
+	}
+	hash := sha512.New384()
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// credentialTypes are the accepted credential types.
+var credentialTypes = []string{"basic", "bearer"}
+
+// Credential stores a named credential, read from the configuration file and referenced by the URLs.
+// Its values are expanded with the environment, e.g. `${API_TOKEN}`, so that secrets are not in the configuration file.
+type Credential struct {
+	Name     string `xml:"name,attr"`
+	Type     string `xml:"type,attr"`               // Either "basic" for basic authentication, or "bearer" for a bearer token.
+	Username string `xml:"username,attr,omitempty"` // Username of the basic authentication.
+	Password string `xml:"password,attr,omitempty"` // Password of the basic authentication.
+	Token    string `xml:"token,attr,omitempty"`    // Token of the bearer authentication.
+}
+
+// RequestBody stores the body of the request of a URL.
+type RequestBody struct {
+	ContentType string `xml:"contentType,attr,omitempty" json:"content_type,omitempty"`
+	Value       string `xml:",chardata" json:"value"`
+}
+
+// Request allows for marshling of the request of a fetch, as configured, in the output log.
+// The header values are not expanded with the environment so that secrets are not logged.
+type Request struct {
+	Method     string       `xml:"method,attr" json:"method"`
+	Credential string       `xml:"credential,attr,omitempty" json:"credential,omitempty"`
+	Headers    []*Header    `xml:"header" json:"headers,omitempty"`
+	Body       *RequestBody `xml:"body" json:"body,omitempty"`
+}
+
+// resolveRequest sets the default method of the URL, checks its request and resolves its credential from the named credentials.
+func (urlInfo *URLInfo) resolveRequest(credentials map[string]*Credential) error {
+	if urlInfo.Method == "" {
+		urlInfo.Method = "GET"
+	}
+	urlInfo.Method = strings.ToUpper(urlInfo.Method)
+	if strings.ContainsAny(urlInfo.Method, " \t\r\n") {
+		return fmt.Errorf("invalid method `%s`", urlInfo.Method)
+	}
+	for _, header := range urlInfo.Headers {
+		if header.Name == "" {
+			return fmt.Errorf("header without a name")
+		}
+	}
+	if urlInfo.Credential != "" {
+		if urlInfo.credential = credentials[urlInfo.Credential]; urlInfo.credential == nil {
+			return fmt.Errorf("unknown credential `%s`", urlInfo.Credential)
+		}
+	}
+	return nil
+}
+
+// CredentialMap returns a map of the credentials by name, or an error if a credential is invalid or defined twice.
+func CredentialMap(credentials []*Credential) (map[string]*Credential, error) {
+	credentialMap := make(map[string]*Credential)
+	for _, credential := range credentials {
+		if credential.Name == "" {
+			return nil, fmt.Errorf("credential without a name")
+		}
+		if _, exists := credentialMap[credential.Name]; exists {
+			return nil, fmt.Errorf("credential `%s` is defined twice", credential.Name)
+		}
+		if !validCredentialType(credential.Type) {
+			return nil, fmt.Errorf("unknown type `%s` of credential `%s`", credential.Type, credential.Name)
+		}
+		credentialMap[credential.Name] = credential
+	}
+	return credentialMap, nil
+}
+
+// urlHeadersKey is the context key of the headers of the URL of a request, which are removed from its redirects to other hosts.
+type urlHeadersKey struct{}
+
+// NewRequest returns the HTTP request of the URL, with its method, headers, body and credential, which is cancelled with the provided context.
+func (urlInfo *URLInfo) NewRequest(ctx context.Context, cleanURL string) (*http.Request, error) {
+	var body io.Reader
+	if urlInfo.Body != nil {
+		body = strings.NewReader(urlInfo.Body.Value)
+	}
+	req, err := http.NewRequestWithContext(context.WithValue(ctx, urlHeadersKey{}, urlInfo.Headers), urlInfo.Method, cleanURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if urlInfo.Body != nil && urlInfo.Body.ContentType != "" {
+		req.Header.Set("Content-Type", urlInfo.Body.ContentType)
+	}
+	for _, header := range urlInfo.Headers {
+		req.Header.Set(header.Name, os.ExpandEnv(header.Value))
+	}
+	if credential := urlInfo.credential; credential != nil {
+		switch credential.Type {
+		case "basic":
+			req.SetBasicAuth(os.ExpandEnv(credential.Username), os.ExpandEnv(credential.Password))
+		case "bearer":
+			req.Header.Set("Authorization", "Bearer "+os.ExpandEnv(credential.Token))
+		}
+	}
+	return req, nil
+}
+
+// Request returns the request of the URL, as written in the output log.
+func (urlInfo *URLInfo) Request() *Request {
+	return &Request{Method: urlInfo.Method, Credential: urlInfo.Credential, Headers: urlInfo.Headers, Body: urlInfo.Body}
+}
+
+// validCredentialType returns whether the provided credential type is accepted.
+func validCredentialType(credType string) bool {
+	for _, accepted := range credentialTypes {
+		if credType == accepted {
+			return true
+		}
+	}
+	return false
+}
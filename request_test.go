@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// TestRequest tests the configuration of the requests of the URLs.
+func TestRequest(t *testing.T) {
+	Convey("The request tests, ", t, func() {
+		configXML := `<config>
+	<credential name="api" type="bearer" token="${GOFETCH_TEST_TOKEN}" />
+	<credential name="login" type="basic" username="user" password="${GOFETCH_TEST_PASSWORD}" />
+	<urls>
+		<url method="post" credential="api">
+			<link>http://example.com/api</link>
+			<header name="Accept">application/json</header>
+			<body contentType="application/json">{"query": "gofetch"}</body>
+			<parser name="RawArticle"><feed id="1" /></parser>
+		</url>
+		<url credential="login">
+			<link>http://example.com/feed</link>
+			<parser name="RawArticle"><feed id="2" /></parser>
+		</url>
+	</urls>
+</config>`
+		os.Setenv("GOFETCH_TEST_TOKEN", "token")
+		os.Setenv("GOFETCH_TEST_PASSWORD", "password")
+		defer os.Unsetenv("GOFETCH_TEST_TOKEN")
+		defer os.Unsetenv("GOFETCH_TEST_PASSWORD")
+		config := &Config{}
+		So(xml.Unmarshal([]byte(configXML), config), ShouldBeNil)
+		So(config.Validate(), ShouldBeNil)
+
+		Convey("The request of a URL has its method, headers, body and credential", func() {
+			urlInfo := config.Urls[0]
+			So(urlInfo.Parser.Name, ShouldEqual, "RawArticle")
+			req, err := urlInfo.NewRequest(context.Background(), urlInfo.Link)
+			So(err, ShouldBeNil)
+			So(req.Method, ShouldEqual, "POST")
+			So(req.Header.Get("Accept"), ShouldEqual, "application/json")
+			So(req.Header.Get("Content-Type"), ShouldEqual, "application/json")
+			So(req.Header.Get("Authorization"), ShouldEqual, "Bearer token")
+			body, _ := ioutil.ReadAll(req.Body)
+			So(string(body), ShouldEqual, `{"query": "gofetch"}`)
+
+			// The logged request does not have the secrets.
+			logged, err := xml.Marshal(urlInfo.Request())
+			So(err, ShouldBeNil)
+			So(string(logged), ShouldContainSubstring, `method="POST" credential="api"`)
+			So(string(logged), ShouldNotContainSubstring, "token")
+		})
+
+		Convey("The request of a URL is a GET by default", func() {
+			req, err := config.Urls[1].NewRequest(context.Background(), config.Urls[1].Link)
+			So(err, ShouldBeNil)
+			So(req.Method, ShouldEqual, "GET")
+			username, password, ok := req.BasicAuth()
+			So(ok, ShouldBeTrue)
+			So(username, ShouldEqual, "user")
+			So(password, ShouldEqual, "password")
+		})
+
+		Convey("Invalid requests and credentials are rejected", func() {
+			So((&Config{Urls: []*URLInfo{{Link: "http://example.com", Parser: Parser{Name: "rss"}, Credential: "carrots"}}}).Validate(), ShouldNotBeNil)
+			So((&Config{Urls: []*URLInfo{{Link: "http://example.com", Parser: Parser{Name: "rss"}, Method: "GET POST"}}}).Validate(), ShouldNotBeNil)
+			So((&Config{Credentials: []*Credential{{Name: "api", Type: "carrots"}}}).Validate(), ShouldNotBeNil)
+			So((&Config{Credentials: []*Credential{{Name: "api", Type: "basic"}, {Name: "api", Type: "bearer"}}}).Validate(), ShouldNotBeNil)
+		})
+	})
+}
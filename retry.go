@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy stores the retry information of a fetch, read from the configuration file either globally or per URL.
+// The attributes which are not set take their default value.
+type RetryPolicy struct {
+	Attempts   int     `xml:"attempts,attr,omitempty"`   // Maximum number of attempts, including the first one.
+	Backoff    float64 `xml:"backoff,attr,omitempty"`    // Delay before the first retry, doubled at each retry.
+	MaxBackoff float64 `xml:"maxBackoff,attr,omitempty"` // Maximum delay between two attempts.
+	Unit       string  `xml:"unit,attr,omitempty"`       // Unit of the delays.
+	Statuses   string  `xml:"statuses,attr,omitempty"`   // Comma separated list of the retryable HTTP statuses.
+	Errors     string  `xml:"errors,attr,omitempty"`     // Whether transient network errors are retryable ("true" or "false").
+
+	backoff    time.Duration // Stores the parsed backoff.
+	maxBackoff time.Duration // Stores the parsed maximum backoff.
+	statuses   map[int]bool  // Stores the parsed retryable statuses.
+	errors     bool          // Stores whether transient network errors are retryable.
+}
+
+// defaultRetryPolicy is the retry policy used when the configuration file does not define one. Its backoff delays are in seconds.
+var defaultRetryPolicy = RetryPolicy{Attempts: 3, Backoff: 1, MaxBackoff: 30, Unit: "s", Statuses: "429,500,502,503,504", Errors: "true"}
+
+// Attempt allows for marshling of a failed fetch attempt in the output log.
+type Attempt struct {
+	Number  int    `xml:"number,attr" json:"number"`
+	Status  int    `xml:"status,attr,omitempty" json:"status,omitempty"`
+	Message string `xml:"message,attr" json:"message"`
+}
+
+// resolve sets the default value of the unset attributes and parses the retry policy.
+func (policy *RetryPolicy) resolve() (err error) {
+	if policy.Attempts == 0 {
+		policy.Attempts = defaultRetryPolicy.Attempts
+	}
+	if policy.Unit == "" {
+		policy.Unit = defaultRetryPolicy.Unit
+	}
+	if policy.Statuses == "" {
+		policy.Statuses = defaultRetryPolicy.Statuses
+	}
+	if policy.Errors == "" {
+		policy.Errors = defaultRetryPolicy.Errors
+	}
+	if policy.Attempts < 1 {
+		return fmt.Errorf("retry attempts must be at least 1, not %d", policy.Attempts)
+	}
+	// The unset delays take the default value, whatever the unit.
+	policy.backoff = time.Duration(defaultRetryPolicy.Backoff * float64(time.Second))
+	if policy.Backoff != 0 {
+		if policy.backoff, err = durationFromConfig(policy.Backoff, policy.Unit); err != nil {
+			return err
+		}
+	}
+	policy.maxBackoff = time.Duration(defaultRetryPolicy.MaxBackoff * float64(time.Second))
+	if policy.MaxBackoff != 0 {
+		if policy.maxBackoff, err = durationFromConfig(policy.MaxBackoff, policy.Unit); err != nil {
+			return err
+		}
+	}
+	policy.statuses = make(map[int]bool)
+	for _, status := range strings.Split(policy.Statuses, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(status))
+		if err != nil {
+			return fmt.Errorf("invalid retryable status `%s`", status)
+		}
+		policy.statuses[code] = true
+	}
+	if policy.errors, err = strconv.ParseBool(policy.Errors); err != nil {
+		return fmt.Errorf("invalid retryable errors `%s`", policy.Errors)
+	}
+	return nil
+}
+
+// RetryableStatus returns whether the HTTP status is retryable.
+func (policy *RetryPolicy) RetryableStatus(status int) bool {
+	return policy.statuses[status]
+}
+
+// RetryableError returns whether the error of an HTTP request is a transient network error, and whether these are retryable.
+// A truncated body is retryable if its error is, but an oversized body is not.
+func (policy *RetryPolicy) RetryableError(err error) bool {
+	if !policy.errors {
+		return false
+	}
+	if bodyErr, ok := err.(*BodyError); ok {
+		if bodyErr.Reason != "truncated" {
+			return false
+		}
+		err = bodyErr.Err
+	}
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, isNetErr := err.(net.Error)
+	return isNetErr
+}
+
+// Delay returns the delay before the next attempt after the provided attempt number, with jitter.
+// The delay is exponential, between half and the full backoff for that attempt, and capped by the maximum backoff.
+func (policy *RetryPolicy) Delay(attempt int) time.Duration {
+	delay := policy.backoff
+	for i := 1; i < attempt && delay < policy.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > policy.maxBackoff {
+		delay = policy.maxBackoff
+	}
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
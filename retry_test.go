@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// TestRetryPolicy tests the parsing and the behavior of the retry policies.
+func TestRetryPolicy(t *testing.T) {
+	Convey("The retry policy tests, ", t, func() {
+		Convey("An empty retry policy takes the default values", func() {
+			policy := &RetryPolicy{}
+			So(policy.resolve(), ShouldBeNil)
+			So(policy.Attempts, ShouldEqual, 3)
+			So(policy.backoff, ShouldEqual, time.Second)
+			So(policy.maxBackoff, ShouldEqual, 30*time.Second)
+			So(policy.RetryableStatus(503), ShouldBeTrue)
+			So(policy.RetryableStatus(404), ShouldBeFalse)
+		})
+
+		Convey("Invalid retry policies are rejected", func() {
+			So((&RetryPolicy{Attempts: -1}).resolve(), ShouldNotBeNil)
+			So((&RetryPolicy{Backoff: 1, Unit: "carrots"}).resolve(), ShouldNotBeNil)
+			So((&RetryPolicy{Statuses: "500,carrots"}).resolve(), ShouldNotBeNil)
+			So((&RetryPolicy{Errors: "carrots"}).resolve(), ShouldNotBeNil)
+		})
+
+		Convey("The delay is exponential with jitter, and capped", func() {
+			policy := &RetryPolicy{Backoff: 100, MaxBackoff: 300, Unit: "ms"}
+			So(policy.resolve(), ShouldBeNil)
+			for i := 0; i < 20; i++ {
+				So(policy.Delay(1), ShouldBeBetweenOrEqual, 50*time.Millisecond, 100*time.Millisecond)
+				So(policy.Delay(2), ShouldBeBetweenOrEqual, 100*time.Millisecond, 200*time.Millisecond)
+				So(policy.Delay(5), ShouldBeBetweenOrEqual, 150*time.Millisecond, 300*time.Millisecond)
+			}
+		})
+
+		Convey("Only transient network errors are retryable", func() {
+			policy := &RetryPolicy{}
+			So(policy.resolve(), ShouldBeNil)
+			So(policy.RetryableError(&url.Error{Op: "Get", URL: "http://example.com", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}), ShouldBeTrue)
+			So(policy.RetryableError(&url.Error{Op: "Get", URL: "http://example.com", Err: io.ErrUnexpectedEOF}), ShouldBeTrue)
+			So(policy.RetryableError(&url.Error{Op: "Get", URL: "http:/example.com", Err: errors.New("http: no Host in request URL")}), ShouldBeFalse)
+			So(policy.RetryableError(&BodyError{Reason: "truncated", Err: io.ErrUnexpectedEOF}), ShouldBeTrue)
+			So(policy.RetryableError(&BodyError{Reason: "oversized", Err: errors.New("body is larger than the maximum")}), ShouldBeFalse)
+
+			policy = &RetryPolicy{Errors: "false"}
+			So(policy.resolve(), ShouldBeNil)
+			So(policy.RetryableError(&url.Error{Op: "Get", URL: "http://example.com", Err: io.ErrUnexpectedEOF}), ShouldBeFalse)
+		})
+	})
+}
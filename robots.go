@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// robotsAgent is the user agent token of gofetch in the robots.txt files, unless another User-Agent is configured.
+const robotsAgent = "gofetch"
+
+// robotsMaxSize is the maximum size of a robots.txt file which is parsed, the rest being ignored.
+const robotsMaxSize = 500 * 1024
+
+// robotsActions are the accepted robots policy actions, the first one being the default.
+var robotsActions = []string{"obey", "ignore"}
+
+// RobotsPolicy stores the default handling of the robots.txt files of the hosts.
+type RobotsPolicy struct {
+	Action string `xml:"action,attr"`
+}
+
+// RobotsRules stores the rules of a robots.txt file which apply to gofetch.
+type RobotsRules struct {
+	rules      []*robotsRule // Stores the allow and disallow rules.
+	crawlDelay time.Duration // Stores the crawl delay, zero if there is none.
+	disallowed bool          // Stores whether all the paths are disallowed, e.g. when the robots.txt file is unavailable.
+}
+
+// robotsRule stores an allow or disallow rule of a robots.txt file.
+type robotsRule struct {
+	allow   bool           // Stores whether the rule allows the matching paths.
+	length  int            // Stores the length of the path pattern, the longest matching pattern taking precedence.
+	pattern *regexp.Regexp // Stores the path pattern.
+}
+
+// RobotsCache stores the rules of the robots.txt file of each host, which is only fetched once per run.
+type RobotsCache struct {
+	sync.Mutex                         // Protects the entries.
+	client     *HTTPClient             // Stores the client which fetches the robots.txt files.
+	entries    map[string]*robotsEntry // Stores the rules per scheme and host.
+}
+
+// robotsEntry stores the rules of a host once they are fetched.
+type robotsEntry struct {
+	ready chan struct{} // Closed once the rules are fetched.
+	rules *RobotsRules  // Stores the rules of the host.
+}
+
+// NewRobotsCache returns a new and empty RobotsCache, which fetches the robots.txt files with the provided client.
+func NewRobotsCache(client *HTTPClient) *RobotsCache {
+	return &RobotsCache{client: client, entries: make(map[string]*robotsEntry)}
+}
+
+// Allowed returns whether the job is allowed by the robots.txt file of its host. The robots.txt file is fetched
+// with the provided context on the first job of the host, and its crawl delay is given to the scheduler.
+func (cache *RobotsCache) Allowed(ctx context.Context, job *fetchJob, scheduler *HostScheduler) bool {
+	link, err := url.Parse(job.cleanURL)
+	if err != nil || link.Host == "" {
+		return true // Note that the error is caught on the GET.
+	}
+	key := link.Scheme + "://" + link.Host
+	cache.Lock()
+	entry, exists := cache.entries[key]
+	if !exists {
+		entry = &robotsEntry{ready: make(chan struct{})}
+		cache.entries[key] = entry
+	}
+	cache.Unlock()
+	if exists {
+		<-entry.ready
+	} else {
+		entry.rules = RobotsRulesFromHost(ctx, cache.client, key)
+		if entry.rules.crawlDelay > 0 {
+			scheduler.SetCrawlDelay(job.host, entry.rules.crawlDelay)
+		}
+		close(entry.ready)
+	}
+	return entry.rules.Allowed(link.RequestURI())
+}
+
+// RobotsRulesFromHost fetches the robots.txt file of the host, given as a scheme and a host, and returns its rules.
+// A missing file allows everything, and an unavailable one disallows everything. Network errors allow everything,
+// in which case the fetch of the URL fails with that error. The rules are those which apply to the product token
+// of the User-Agent of the client.
+func RobotsRulesFromHost(ctx context.Context, client *HTTPClient, host string) *RobotsRules {
+	req, err := http.NewRequestWithContext(ctx, "GET", host+"/robots.txt", nil)
+	if err != nil {
+		log.Warning("Could not fetch the robots.txt of %s: %s.", host, err)
+		return &RobotsRules{}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Warning("Could not fetch the robots.txt of %s: %s.", host, err)
+		return &RobotsRules{}
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 500:
+		log.Warning("The robots.txt of %s is unavailable (HTTP status %s), disallowing all its URLs.", host, resp.Status)
+		return &RobotsRules{disallowed: true}
+	case resp.StatusCode >= 400:
+		log.Info("%s has no robots.txt (HTTP status %s).", host, resp.Status)
+		return &RobotsRules{}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, robotsMaxSize))
+	if err != nil {
+		log.Warning("Could not read the robots.txt of %s: %s.", host, err)
+		return &RobotsRules{}
+	}
+	rules := ParseRobots(body, RobotsToken(client.config.UserAgent))
+	log.Info("Fetched the robots.txt of %s, with %d rules and a crawl delay of %s.", host, len(rules.rules), rules.crawlDelay)
+	return rules
+}
+
+// RobotsToken returns the product token of the provided User-Agent, i.e. its part before the first slash or space,
+// which names the agent in the robots.txt files, or the token of gofetch if it is empty.
+func RobotsToken(userAgent string) string {
+	if end := strings.IndexAny(userAgent, "/ "); end >= 0 {
+		userAgent = userAgent[:end]
+	}
+	if userAgent == "" {
+		return robotsAgent
+	}
+	return userAgent
+}
+
+// ParseRobots returns the rules of a robots.txt file which apply to the provided user agent, which are those of
+// the groups naming the agent, or else those of the groups for all agents.
+func ParseRobots(body []byte, agent string) *RobotsRules {
+	agentRules, anyRules := &RobotsRules{}, &RobotsRules{}
+	matchesAgent, matchesAny := false, false
+	var current []*RobotsRules
+	inAgents := false // Whether the previous lines are user-agent lines, which start a group together.
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if comment := strings.Index(line, "#"); comment >= 0 {
+			line = line[:comment]
+		}
+		sep := strings.Index(line, ":")
+		if sep < 0 {
+			continue
+		}
+		key, value := strings.ToLower(strings.TrimSpace(line[:sep])), strings.TrimSpace(line[sep+1:])
+		if key == "user-agent" {
+			if !inAgents {
+				current = nil
+			}
+			inAgents = true
+			switch {
+			case strings.EqualFold(value, agent):
+				matchesAgent = true
+				current = append(current, agentRules)
+			case value == "*":
+				matchesAny = true
+				current = append(current, anyRules)
+			}
+			continue
+		}
+		inAgents = false
+		for _, rules := range current {
+			switch key {
+			case "allow", "disallow":
+				if value != "" {
+					rules.rules = append(rules.rules, newRobotsRule(key == "allow", value))
+				}
+			case "crawl-delay":
+				if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+					rules.crawlDelay = time.Duration(seconds * float64(time.Second))
+				}
+			}
+		}
+	}
+	if matchesAgent || !matchesAny {
+		return agentRules
+	}
+	return anyRules
+}
+
+// newRobotsRule returns the rule of a path pattern, in which `*` matches any sequence of characters and a final `$` matches the end of the path.
+func newRobotsRule(allow bool, path string) *robotsRule {
+	anchored := strings.HasSuffix(path, "$")
+	expr := regexp.QuoteMeta(strings.TrimSuffix(path, "$"))
+	expr = "^" + strings.Replace(expr, `\*`, ".*", -1)
+	if anchored {
+		expr += "$"
+	}
+	return &robotsRule{allow: allow, length: len(path), pattern: regexp.MustCompile(expr)}
+}
+
+// Allowed returns whether the path, with its query, is allowed. The longest matching rule applies, an allow rule
+// taking precedence over a disallow rule of the same length, and the paths matching no rule are allowed.
+func (rules *RobotsRules) Allowed(path string) bool {
+	if rules.disallowed {
+		return false
+	}
+	allowed, length := true, -1
+	for _, rule := range rules.rules {
+		if rule.pattern.MatchString(path) && (rule.length > length || (rule.length == length && rule.allow)) {
+			allowed, length = rule.allow, rule.length
+		}
+	}
+	return allowed
+}
+
+// validRobotsAction returns whether the provided robots policy action is accepted.
+func validRobotsAction(action string) bool {
+	for _, accepted := range robotsActions {
+		if action == accepted {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+// TestRobots tests the parsing and the matching of the robots.txt rules.
+func TestRobots(t *testing.T) {
+	Convey("The robots.txt tests, ", t, func() {
+		body := []byte(`# Comments are ignored.
+User-agent: *
+Disallow: /private/
+Allow: /private/public$
+
+User-agent: otherbot
+User-agent: GoFetch
+Disallow: /feeds/*.xml
+Allow: /feeds/open/
+Crawl-delay: 2.5
+`)
+
+		Convey("The groups naming gofetch apply instead of the groups for all agents", func() {
+			rules := ParseRobots(body, robotsAgent)
+			So(rules.crawlDelay, ShouldEqual, 2500*time.Millisecond)
+			So(rules.Allowed("/private/feed"), ShouldBeTrue)
+			So(rules.Allowed("/feeds/latest.xml"), ShouldBeFalse)
+			So(rules.Allowed("/feeds/latest.xml?page=2"), ShouldBeFalse)
+			So(rules.Allowed("/feeds/open/latest.xml"), ShouldBeTrue)
+			So(rules.Allowed("/feeds/latest.rss"), ShouldBeTrue)
+		})
+
+		Convey("The groups for all agents apply to the other agents", func() {
+			rules := ParseRobots(body, "somebot")
+			So(rules.crawlDelay, ShouldEqual, 0)
+			So(rules.Allowed("/private/feed"), ShouldBeFalse)
+			So(rules.Allowed("/private/public"), ShouldBeTrue)
+			So(rules.Allowed("/private/public/feed"), ShouldBeFalse)
+			So(rules.Allowed("/feeds/latest.xml"), ShouldBeTrue)
+		})
+
+		Convey("The rules apply to the product token of the configured User-Agent", func() {
+			So(RobotsToken(""), ShouldEqual, "gofetch")
+			So(RobotsToken("OtherBot"), ShouldEqual, "OtherBot")
+			So(RobotsToken("OtherBot/1.2 (+http://example.com/bot)"), ShouldEqual, "OtherBot")
+			rules := ParseRobots(body, RobotsToken("otherbot/1.2"))
+			So(rules.crawlDelay, ShouldEqual, 2500*time.Millisecond)
+			So(rules.Allowed("/feeds/latest.xml"), ShouldBeFalse)
+		})
+
+		Convey("An empty robots.txt allows everything and an unavailable one disallows everything", func() {
+			So(ParseRobots([]byte(""), robotsAgent).Allowed("/feed"), ShouldBeTrue)
+			So(ParseRobots([]byte("User-agent: *\nDisallow:\n"), robotsAgent).Allowed("/feed"), ShouldBeTrue)
+			So((&RobotsRules{disallowed: true}).Allowed("/feed"), ShouldBeFalse)
+		})
+
+		Convey("Invalid robots policy actions are rejected", func() {
+			config := &Config{Robots: &RobotsPolicy{Action: "carrots"}}
+			So(config.Validate(), ShouldNotBeNil)
+			config = &Config{Urls: []*URLInfo{{Link: "http://example.com/feed", Parser: Parser{Name: "rss"}, Robots: "carrots"}}}
+			So(config.Validate(), ShouldNotBeNil)
+		})
+	})
+}
@@ -1,24 +1,47 @@
 package main
 
 import (
+	"context"
 	"encoding/xml"
 	"fmt"
 	"os"
 	"sync"
 	"time"
 
+	"github.com/Sparrho/gofetch/content"
 	"github.com/mitchellh/goamz/aws"
 	"github.com/mitchellh/goamz/s3"
 )
 
 // Config allows for unmarshling of the remote configuration file.
 type Config struct {
-	XMLName    xml.Name     `xml:"config"`
-	Indexes    []*Index     `xml:"index"`
-	Throttlers []*Throttler `xml:"throttle"`
-	Urls       []*URLInfo   `xml:"urls>url"`
+	XMLName         xml.Name      `xml:"config"`
+	Indexes         []*Index      `xml:"index"`
+	Throttlers      []*Throttler  `xml:"throttle"`
+	DefaultThrottle *Throttler    `xml:"defaultThrottle"`
+	StatusPolicy    *StatusPolicy `xml:"statusPolicy"`
+	Retry           *RetryPolicy  `xml:"retry"`
+	Robots          *RobotsPolicy `xml:"robots"`
+	Client          *ClientConfig `xml:"client"`
+	Credentials     []*Credential `xml:"credential"`
+	BodyLimit       *BodyLimit    `xml:"bodyLimit"`
+	Compression     *Compression  `xml:"compression"`
+	Urls            []*URLInfo    `xml:"urls>url"`
 }
 
+// StatusPolicy stores the default handling of the responses with a non-success HTTP status.
+type StatusPolicy struct {
+	Action string `xml:"action,attr"`
+}
+
+// BodyLimit stores the default maximum size of the response bodies, in bytes.
+type BodyLimit struct {
+	MaxSize int64 `xml:"maxSize,attr"`
+}
+
+// statusActions are the accepted status policy actions, the first one being the default.
+var statusActions = []string{"error", "store", "skip", "retry"}
+
 // Index stores the index information, with their name and enable status.
 type Index struct {
 	XMLName xml.Name `xml:"index"`
@@ -28,221 +51,583 @@ type Index struct {
 
 // URLInfo stores the URL info which is to be fetched.
 type URLInfo struct {
-	XMLName xml.Name `xml:"url"`
-	Link    string   `xml:"link"`
-	Parser  Parser   `xml:",any"`
+	XMLName      xml.Name     `xml:"url"`
+	StatusPolicy string       `xml:"statusPolicy,attr,omitempty"`
+	Robots       string       `xml:"robots,attr,omitempty"`
+	Method       string       `xml:"method,attr,omitempty"`
+	Credential   string       `xml:"credential,attr,omitempty"`
+	MaxBodySize  int64        `xml:"maxBodySize,attr,omitempty"`
+	Link         string       `xml:"link"`
+	Headers      []*Header    `xml:"header"`
+	Body         *RequestBody `xml:"body"`
+	Retry        *RetryPolicy `xml:"retry"`
+	Parser       Parser       `xml:",any"`
+
+	credential *Credential // Stores the credential referenced by name.
+	position   int         // Stores the position of the URL in the configuration file.
 }
 
 // Parser stores the parse meta data, which will be written back in the output log.
 type Parser struct {
-	XMLName xml.Name
-	Name    string `xml:"name,attr"`
-	XML     string `xml:",innerxml"`
+	XMLName xml.Name `json:"-"`
+	Name    string   `xml:"name,attr" json:"name"`
+	XML     string   `xml:",innerxml" json:"xml"`
 }
 
-// Throttler stores the throttle information read from the configuration file.
+// Throttler stores the throttle information read from the configuration file. The default throttle has no host.
 type Throttler struct {
-	Host  string  `xml:"host,attr"`
-	Unit  string  `xml:"unit,attr"`
-	Delay float64 `xml:"delay,attr"`
+	Host        string  `xml:"host,attr"`
+	Unit        string  `xml:"unit,attr"`
+	Delay       float64 `xml:"delay,attr"`
+	Concurrency int     `xml:"concurrency,attr,omitempty"`
 }
 
 // GetDuration validates and returns the parsed duration.
 func (throttle Throttler) GetDuration() (delay time.Duration, err error) {
-	delayStr := fmt.Sprintf("%f%s", throttle.Delay, throttle.Unit)
-	delay, err = time.ParseDuration(delayStr)
+	delay, err = durationFromConfig(throttle.Delay, throttle.Unit)
 	if err != nil {
-		log.Critical("Could not parse duration %s: %s", delayStr, err.Error())
+		log.Critical("Could not parse duration: %s", err.Error())
 	}
 	return
 }
 
+// HTTPThrottler returns a new HTTPThrottler from the throttle, whose concurrency defaults to the provided value.
+// Returns nil if the duration cannot be parsed.
+func (throttle Throttler) HTTPThrottler(defaultConcurrency int) *HTTPThrottler {
+	delay, err := throttle.GetDuration()
+	if err != nil {
+		return nil // Error is logged in Duration function.
+	}
+	concurrency := throttle.Concurrency
+	if concurrency == 0 {
+		concurrency = defaultConcurrency
+	}
+	// Initialize the latest fetch to yesterday.
+	return &HTTPThrottler{delay: delay, concurrency: concurrency, latestFetch: time.Now().AddDate(0, 0, -1)}
+}
+
+// durationFromConfig returns the duration from a delay and its unit, as written in the configuration file.
+func durationFromConfig(delay float64, unit string) (time.Duration, error) {
+	return time.ParseDuration(fmt.Sprintf("%f%s", delay, unit))
+}
+
 // Fetches allows for marshling of output log.
 type Fetches struct {
-	XMLName    xml.Name      `xml:"fetches"`
-	Fetch      []*Fetch      `xml:"fetch"`
-	FetchError []*FetchError `xml:"error"`
-	Meta       *Meta         `xml:"meta"`
+	XMLName     xml.Name       `xml:"fetches" json:"-"`
+	Fetch       []*Fetch       `xml:"fetch" json:"fetches,omitempty"`
+	FetchError  []*FetchError  `xml:"error" json:"errors,omitempty"`
+	Unattempted []*Unattempted `xml:"unattempted" json:"unattempted,omitempty"`
+	DeadLetters []*DeadLetter  `xml:"deadLetter" json:"dead_letters,omitempty"`
+	Meta        *Meta          `xml:"meta" json:"meta"`
 }
 
 // Fetch allows for marshling of single fetch result in output log.
 type Fetch struct {
-	Novel         bool       `xml:"novel,attr"`
-	Parser        string     `xml:"parser,attr"`
-	ChecksumIndex S3Location `xml:"checksumIndex"`
-	S3Content     S3Location `xml:"s3content"`
-	ParserData    Parser     `xml:"parser"`
+	Novel          bool       `xml:"novel,attr" json:"novel"`
+	Unchanged      bool       `xml:"unchanged,attr" json:"unchanged"`
+	Encoding       string     `xml:"encoding,attr,omitempty" json:"encoding,omitempty"`
+	Parser         string     `xml:"parser,attr" json:"parser"`
+	Status         int        `xml:"status,attr" json:"status"`
+	FinalLink      string     `xml:"final_link,attr" json:"final_link"`
+	Attempts       int        `xml:"attempts,attr" json:"attempts"`
+	ChecksumIndex  S3Location `xml:"checksumIndex" json:"checksum_index"`
+	S3Content      S3Location `xml:"s3content" json:"s3_content"`
+	S3Metadata     S3Location `xml:"s3metadata" json:"s3_metadata"`
+	ParserData     Parser     `xml:"parser" json:"parser_data"`
+	Headers        []*Header  `xml:"header" json:"headers,omitempty"`
+	FailedAttempts []*Attempt `xml:"attempt" json:"failed_attempts,omitempty"`
+	Request        *Request   `xml:"request" json:"request"`
+
+	urlInfo *URLInfo // Stores the URL of the fetch, for the checkpoint of the run.
 }
 
-// FetchError allows for marshling of a fetching error.
+// Header allows for marshling of a response header of a fetch, and stores a request header of a URL.
+type Header struct {
+	Name  string `xml:"name,attr" json:"name"`
+	Value string `xml:",chardata" json:"value"`
+}
+
+// ContentMetadata allows for marshling of the metadata of a content, from the response of the fetch which stored it.
+type ContentMetadata struct {
+	XMLName     xml.Name  `xml:"metadata"`
+	ContentType string    `xml:"content_type,attr"`
+	Encoding    string    `xml:"encoding,attr"`
+	Status      int       `xml:"status,attr"`
+	FinalLink   string    `xml:"final_link,attr"`
+	FetchTime   time.Time `xml:"fetch_time,attr"`
+	Headers     []*Header `xml:"header"`
+}
+
+// FetchError allows for marshling of a fetching error. Its reason is "request" if the request failed, "truncated" if the
+// response body could not be read entirely, "oversized" if the body is larger than the maximum size, "status" if the
+// response has a non-success HTTP status, "robots" if the URL is disallowed by the robots.txt file of its host, "deadline"
+// if its fetch deadline passed, "interrupted" if the run was interrupted before its retry, or "cutoff" if the run deadline
+// cut off its fetch or its storage.
 type FetchError struct {
-	Original string `xml:"original_link,attr"`
-	Cleaned  string `xml:"clean_link,attr"`
-	Message  string `xml:"message,attr"`
+	Original       string     `xml:"original_link,attr" json:"original_link"`
+	Cleaned        string     `xml:"clean_link,attr" json:"clean_link"`
+	Status         int        `xml:"status,attr,omitempty" json:"status,omitempty"`
+	Reason         string     `xml:"reason,attr" json:"reason"`
+	Message        string     `xml:"message,attr" json:"message"`
+	Attempts       int        `xml:"attempts,attr" json:"attempts"`
+	FailedAttempts []*Attempt `xml:"attempt" json:"failed_attempts,omitempty"`
+
+	urlInfo *URLInfo // Stores the URL of the error, for the checkpoint of the run.
+}
+
+// Unattempted allows for marshling of a URL which was never attempted because the run was interrupted or cut off.
+type Unattempted struct {
+	Original string `xml:"original_link,attr" json:"original_link"`
+	Cleaned  string `xml:"clean_link,attr" json:"clean_link"`
+}
+
+// DeadLetter allows for marshling of a fetch which could not be stored after all its storage attempts, which are listed.
+// It is not checkpointed, so that it is fetched again by the resumed run.
+type DeadLetter struct {
+	Original       string     `xml:"original_link,attr" json:"original_link"`
+	Cleaned        string     `xml:"clean_link,attr" json:"clean_link"`
+	Checksum       string     `xml:"checksum,attr" json:"checksum"`
+	Message        string     `xml:"message,attr" json:"message"`
+	Attempts       int        `xml:"attempts,attr" json:"attempts"`
+	FailedAttempts []*Attempt `xml:"attempt" json:"failed_attempts,omitempty"`
 }
 
 // Meta allows for marshling of the meta information of a run.
 type Meta struct {
-	Report        *Report        `xml:"report"`
-	FetchDuration *FetchDuration `xml:"duration"`
+	Result        *Result        `xml:"result" json:"result"`
+	Report        *Report        `xml:"report" json:"report"`
+	FetchDuration *FetchDuration `xml:"duration" json:"duration"`
+}
+
+// Result allows for marshling of the result of a run.
+type Result struct {
+	Status string `xml:"status,attr" json:"status"`                   // Either "completed", "partial" if some URLs failed or could not be stored, "interrupted" by a signal, "cutoff" by the run deadline, or "aborted" if a fatal error stopped the run.
+	Fatal  string `xml:"fatal,attr,omitempty" json:"fatal,omitempty"` // Error which aborted the run, in which case the log is partial.
 }
 
 // FetchDuration allows for marshling of the duration of a run.
 type FetchDuration struct {
-	Hours   float64 `xml:"hours,attr"`
-	Minutes float64 `xml:"minutes,attr"`
-	Seconds float64 `xml:"seconds,attr"`
+	Hours   float64 `xml:"hours,attr" json:"hours"`
+	Minutes float64 `xml:"minutes,attr" json:"minutes"`
+	Seconds float64 `xml:"seconds,attr" json:"seconds"`
 }
 
 // Report allows for marshling of the report of a run.
 type Report struct {
-	Novel  int `xml:"novel,attr"`
-	Errors int `xml:"errors,attr"`
-	Total  int `xml:"total,attr"`
+	Novel       int `xml:"novel,attr" json:"novel"`
+	Unchanged   int `xml:"unchanged,attr" json:"unchanged"`
+	Errors      int `xml:"errors,attr" json:"errors"`
+	Total       int `xml:"total,attr" json:"total"`
+	Unattempted int `xml:"unattempted,attr,omitempty" json:"unattempted,omitempty"`
+	DeadLetters int `xml:"dead_letters,attr,omitempty" json:"dead_letters,omitempty"`
 }
 
 // S3Location allows for marshling of a file location on S3.
 type S3Location struct {
-	Bucket string `xml:"bucket,attr"`
-	Path   string `xml:"path,attr"`
+	Bucket string `xml:"bucket,attr" json:"bucket"`
+	Path   string `xml:"path,attr" json:"path"`
 }
 
-// S3BucketFromOS returns the bucket from the environment variables (cf. README.md).
-func S3BucketFromOS() *s3.Bucket {
+// S3BucketFromOS returns the bucket from the environment variables (cf. README.md), or an error if the AWS credentials are missing.
+func S3BucketFromOS() (*s3.Bucket, error) {
 	// Prepare AWS S3 connection.
 	s3auth, err := aws.EnvAuth()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	client := s3.New(s3auth, aws.USEast)
-	return client.Bucket(os.Getenv("AWS_STORAGE_BUCKET_NAME"))
+	return client.Bucket(os.Getenv("AWS_STORAGE_BUCKET_NAME")), nil
+}
+
+// Validate validates the configuration and sets the default status and retry policies of the URLs which do not define them.
+func (config *Config) Validate() error {
+	if config.Retry == nil {
+		defaultRetry := defaultRetryPolicy
+		config.Retry = &defaultRetry
+	}
+	if err := config.Retry.resolve(); err != nil {
+		return err
+	}
+	if config.Client == nil {
+		defaultClient := defaultClientConfig
+		config.Client = &defaultClient
+	}
+	if err := config.Client.resolve(); err != nil {
+		return err
+	}
+	defaultAction := statusActions[0]
+	if config.StatusPolicy != nil {
+		if !validStatusAction(config.StatusPolicy.Action) {
+			return fmt.Errorf("unknown status policy action `%s`", config.StatusPolicy.Action)
+		}
+		defaultAction = config.StatusPolicy.Action
+	}
+	defaultRobots := robotsActions[0]
+	if config.Robots != nil {
+		if !validRobotsAction(config.Robots.Action) {
+			return fmt.Errorf("unknown robots policy action `%s`", config.Robots.Action)
+		}
+		defaultRobots = config.Robots.Action
+	}
+	if config.Compression == nil {
+		config.Compression = &Compression{Encoding: contentEncodings[0]}
+	} else if !validContentEncoding(config.Compression.Encoding) {
+		return fmt.Errorf("unknown content encoding `%s`", config.Compression.Encoding)
+	}
+	maxBodySize := int64(defaultMaxBodySize)
+	if config.BodyLimit != nil {
+		if config.BodyLimit.MaxSize <= 0 {
+			return fmt.Errorf("the maximum body size must be positive, not %d", config.BodyLimit.MaxSize)
+		}
+		maxBodySize = config.BodyLimit.MaxSize
+	}
+	credentials, err := CredentialMap(config.Credentials)
+	if err != nil {
+		return err
+	}
+	for _, urlInfo := range config.Urls {
+		if urlInfo.Parser.Name == "" {
+			return fmt.Errorf("the parser name is missing for %s", urlInfo.Link)
+		}
+		if err := urlInfo.resolveRequest(credentials); err != nil {
+			return fmt.Errorf("%s for %s", err, urlInfo.Link)
+		}
+		if urlInfo.MaxBodySize == 0 {
+			urlInfo.MaxBodySize = maxBodySize
+		} else if urlInfo.MaxBodySize < 0 {
+			return fmt.Errorf("the maximum body size must be positive, not %d for %s", urlInfo.MaxBodySize, urlInfo.Link)
+		}
+		if urlInfo.Robots == "" {
+			urlInfo.Robots = defaultRobots
+		} else if !validRobotsAction(urlInfo.Robots) {
+			return fmt.Errorf("unknown robots policy action `%s` for %s", urlInfo.Robots, urlInfo.Link)
+		}
+		if urlInfo.StatusPolicy == "" {
+			urlInfo.StatusPolicy = defaultAction
+		} else if !validStatusAction(urlInfo.StatusPolicy) {
+			return fmt.Errorf("unknown status policy action `%s` for %s", urlInfo.StatusPolicy, urlInfo.Link)
+		}
+		if urlInfo.Retry == nil {
+			urlInfo.Retry = config.Retry
+		} else if err := urlInfo.Retry.resolve(); err != nil {
+			return fmt.Errorf("%s for %s", err, urlInfo.Link)
+		}
+	}
+	return nil
+}
+
+// validStatusAction returns whether the provided status policy action is accepted.
+func validStatusAction(action string) bool {
+	for _, accepted := range statusActions {
+		if action == accepted {
+			return true
+		}
+	}
+	return false
 }
 
-// ConfigFromS3 reads the config file from AWS S3, from the environment variables.
+// ConfigFromStorage reads the config file from the storage, from the environment variables.
 //
-// From a given bucket and a configPath, ConfigFromS3 will return a Config
+// From a given storage and a configPath, ConfigFromStorage will return a Config
 // struct which is an exact representation of the XML file.
-// WARNING: May panic if config is not found or data cannot be unmarshalled.
-func ConfigFromS3() *Config {
-	bucket := S3BucketFromOS()
+// An error is returned if config is not found or data cannot be unmarshalled.
+func ConfigFromStorage(store Storage) (*Config, error) {
 	configPath := os.Getenv("AWS_CONFIG_FILE")
-	configBody, notFoundErr := bucket.Get(configPath)
+	configBody, notFoundErr := store.Get(configPath)
 	if notFoundErr != nil {
-		// Oops, couldn't find the configuration file! Gotta panic now!
-		panic(notFoundErr)
+		return nil, fmt.Errorf("could not read the configuration file %s: %s", configPath, notFoundErr)
 	}
 	config := Config{}
 	xmlErr := xml.Unmarshal(configBody, &config)
 	if xmlErr != nil {
-		// Oops, couldn't read the configuration file! Gotta panic now!
-		panic(xmlErr)
+		return nil, fmt.Errorf("could not parse the configuration file %s: %s", configPath, xmlErr)
 	}
-	return &config
+	return &config, nil
+}
+
+// StorageWriter stores the content, the indexes and the cache validators of the fetches, and logs them. It is shared by the S3 writers.
+type StorageWriter struct {
+	store       Storage            // Stores the storage of the content and the indexes.
+	leases      LeaseCoordinator   // Stores the leases of the content uploads.
+	encoding    string             // Stores the encoding of the stored content.
+	indexes     []IndexInterface   // Stores the secondary indexes.
+	retry       *RetryPolicy       // Stores the retry policy of the storage of a fetch.
+	queueSize   int                // Stores the maximum number of fetches waiting for a retry per writer.
+	logChan     chan<- *Fetch      // Stores the logs of the stored fetches.
+	errChan     chan<- *FetchError // Stores the errors of the fetches cut off before being stored.
+	deadLetters *DeadLetters       // Stores the fetches which could not be stored.
 }
 
-// ProcessResponses processes all the HTTPFetch and writes the content and indexes to S3.
-func ProcessResponses(s3chan chan *HTTPFetch, logChan chan<- *Fetch, indexes []*Index, wg *sync.WaitGroup) {
-	bucket := S3BucketFromOS()
+// ProcessResponses processes all the HTTPFetch and writes the content, encoded with the provided encoding, and indexes to the storage.
+// A fetch which could not be stored is retried after a backoff, as per the retry policy, and is dead lettered after its last attempt.
+// The writer holds its retries in a bounded queue, and does not take new fetches while the queue is full.
+// Once the context of the run is done, the fetches are no longer stored but logged as errors.
+// Each fetch is marked done in the wait group once it is logged, logged as an error or dead lettered.
+func (writer *StorageWriter) ProcessResponses(ctx context.Context, s3chan <-chan *HTTPFetch, wg *sync.WaitGroup) {
+	retries := newRetryQueue(writer.queueSize)
 	for {
-		fetch, open := <-s3chan
-		if !open {
+		fetch, more := retries.Next(ctx, s3chan)
+		if !more {
 			log.Info("Done processing responses: the s3chan is closed.")
 			return
 		}
-		log.Debug("%s was fetched (status=%s) in %s.\n", fetch.urlInfo.Link, fetch.response.Status, fetch.duration)
-		rootPath := "/gofetch"
-		if testGofetch {
-			rootPath += "/test_data"
-		}
-		contentPath := fmt.Sprintf("%s/sha384_content/%s", rootPath, fetch.checksum)
-		// Check whether the checksum is in the canonical index.
-		idx := CanonicalIndex{}
-		indexData, notFoundErr := bucket.Get(idx.Path(fetch, rootPath))
-		if notFoundErr == nil {
-			// Append index content to the index.
-			indexData := string(indexData) + idx.Content(fetch, contentPath)
-			s3Err := bucket.Put(idx.Path(fetch, rootPath), []byte(indexData), "text/plain", s3.Private)
-			if s3Err != nil {
-				// If somethting goes wrong, let's re-add this fetch to items to be processed.
-				s3chan <- fetch
-				log.Error("Could not update index: %s", s3Err)
-				continue
-			}
-			// Log the success.
-			logChan <- &Fetch{Novel: false, Parser: fetch.urlInfo.Parser.Name, ChecksumIndex: S3Location{Bucket: bucket.Name, Path: idx.Path(fetch, rootPath)}, S3Content: S3Location{Bucket: bucket.Name, Path: contentPath}, ParserData: fetch.urlInfo.Parser}
-
-		} else {
-			// Store the content on S3. Note that we set *all* content types to text/plain.
-			s3Err := bucket.Put(contentPath, fetch.body, "text/plain", s3.Private)
-			if s3Err != nil {
-				// If somethting goes wrong, let's re-add this fetch to items to be processed.
-				s3chan <- fetch
-				log.Error("Could not PUT new content: %s", s3Err)
+		if ctx.Err() != nil {
+			// The run is stopped, so the fetches not stored yet are dropped, to be fetched again by the resumed run.
+			reason := stopReason(ctx)
+			writer.errChan <- &FetchError{urlInfo: fetch.urlInfo, Cleaned: fetch.cleanURL, Original: fetch.urlInfo.Link, Reason: reason, Message: stoppedMessage(reason, "before being stored"),
+				Attempts: fetch.attempts, FailedAttempts: fetch.failedAttempts}
+		} else if err := writer.write(fetch); err != nil {
+			attempt := len(fetch.storeFailures) + 1
+			fetch.storeFailures = append(fetch.storeFailures, &Attempt{Number: attempt, Message: err.Error()})
+			if attempt < writer.retry.Attempts {
+				delay := writer.retry.Delay(attempt)
+				log.Error("Storage attempt %d of %s failed (%s), retrying in %s.", attempt, fetch.urlInfo.Link, err, delay)
+				fetch.retryAt = time.Now().Add(delay)
+				retries.Add(fetch)
 				continue
 			}
+			log.Critical("Could not store %s after %d attempts: %s.", fetch.urlInfo.Link, attempt, err)
+			writer.deadLetters.Add(&DeadLetter{Original: fetch.urlInfo.Link, Cleaned: fetch.cleanURL, Checksum: fetch.checksum, Message: err.Error(),
+				Attempts: attempt, FailedAttempts: fetch.storeFailures})
+		}
+		fetch.Close()
+		wg.Done()
+	}
+}
 
-			// Add canonical index information.
-			for i := 0; i < 10; i++ {
-				s3Err = bucket.Put(idx.Path(fetch, rootPath), []byte(idx.Content(fetch, contentPath)), "text/plain", s3.Private)
-				if s3Err == nil {
-					break
-				} else if i == 9 {
-					// Panic: we have attempted to add the index information ten times.
-					panic(fmt.Sprintf("Could not add index: path=%s ; content=[%s]", idx.Path(fetch, rootPath), idx.Content(fetch, contentPath)))
-				}
-			}
+// write stores the fetch, its indexes and its cache validators, and logs it. It returns the error which prevented it from being
+// stored, in which case it is not logged. The canonical index entry of the fetch is only written once across its attempts.
+func (writer *StorageWriter) write(fetch *HTTPFetch) error {
+	store := writer.store
+	log.Debug("%s was fetched (status=%s) in %s.\n", fetch.urlInfo.Link, fetch.response.Status, fetch.duration)
+	rootPath := storageRoot()
+	contentPath := fmt.Sprintf("%s/sha384_content/%s", rootPath, fetch.checksum)
+	idx := CanonicalIndex{}
+	if fetch.unchanged {
+		// The content was not modified since the previous fetch, so only the secondary indexes are updated.
+		fetch.encoding = storedEncoding(store, contentPath)
+		writer.logChan <- fetchLog(store, fetch, idx.Path(fetch, rootPath), contentPath)
+		writeIndexes(store, writer.indexes, fetch, rootPath, contentPath)
+		return nil
+	}
+	// Write the entry of the fetch to the canonical index, which atomically decides whether the checksum is novel.
+	if fetch.indexEntry == "" {
+		indexEntry, novel, err := idx.WriteEntry(store, fetch, rootPath, contentPath)
+		if err != nil {
+			return fmt.Errorf("could not update index: %s", err)
+		}
+		fetch.indexEntry, fetch.novel = indexEntry, novel
+	}
+	// Store the novel content, or the content whose first writer did not store it, e.g. because it crashed.
+	exists, err := store.Exists(contentPath)
+	if err != nil {
+		return fmt.Errorf("could not check content: %s", err)
+	}
+	if fetch.novel || !exists {
+		stored, err := uploadContent(store, writer.leases, fetch, contentPath, writer.encoding)
+		if err != nil {
+			return fmt.Errorf("could not PUT new content: %s", err)
+		}
+		// The content is novel for the fetch which stores it, even if it did not claim the first index entry, so that it
+		// is still indexed as novel when its first writer did not store it.
+		fetch.novel = stored
+	} else {
+		fetch.encoding = storedEncoding(store, contentPath)
+	}
+	// Log the success.
+	writer.logChan <- fetchLog(store, fetch, fetch.indexEntry, contentPath)
+
+	// Save the cache validators for the next conditional fetch of this link.
+	if validators := ValidatorsFromResponse(fetch); validators != nil {
+		if s3Err := store.Put(validatorsPath(rootPath, fetch.urlInfo.Link), []byte(validators.String()), "text/plain"); s3Err != nil {
+			log.Warning("Could not save cache validators of %s: %s", fetch.urlInfo.Link, s3Err)
+		}
+	}
 
-			// Log the success.
-			logChan <- &Fetch{Novel: true, Parser: fetch.urlInfo.Parser.Name, ChecksumIndex: S3Location{Bucket: bucket.Name, Path: idx.Path(fetch, rootPath)}, S3Content: S3Location{Bucket: bucket.Name, Path: contentPath}, ParserData: fetch.urlInfo.Parser}
+	writeIndexes(store, writer.indexes, fetch, rootPath, contentPath)
+	return nil
+}
 
+// uploadContent stores the content of the fetch encoded with the provided encoding, and its metadata next to it, unless
+// another writer holds the lease of its checksum or has stored them meanwhile. It returns whether it stored them.
+func uploadContent(store Storage, leases LeaseCoordinator, fetch *HTTPFetch, contentPath string, encoding string) (bool, error) {
+	acquired, err := leases.Acquire(fetch.checksum)
+	if err != nil || !acquired {
+		// The encoding is unknown while another writer stores the content.
+		fetch.encoding = ""
+		return false, err
+	}
+	defer func() {
+		if err := leases.Release(fetch.checksum); err != nil {
+			log.Warning("Could not release the lease of %s: %s", fetch.checksum, err)
 		}
+	}()
+	// The metadata is stored last, so the content is fully stored if its metadata exists.
+	metadataPath := contentPath + ".meta"
+	if exists, err := store.Exists(metadataPath); err != nil || exists {
+		if exists {
+			fetch.encoding = storedEncoding(store, contentPath)
+		}
+		return false, err
+	}
+	// Store the content on S3 with its original content type and encoded, and its metadata next to it.
+	fetch.encoding = encoding
+	if err = storeContent(store, contentPath, fetch.body, encoding, fetch.contentType()); err != nil {
+		return false, err
+	}
+	metadata, _ := xml.MarshalIndent(fetch.metadata(), "", "\t")
+	if err = store.Put(metadataPath, append([]byte(xml.Header), metadata...), "application/xml"); err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-		// Here goes alternate index managers.
-		for _, index := range indexes {
-			if index.Name == "demo_index_dead_code" {
-				// Implementation of the new index in a similar fashion to the code above.
-				// Use bucket.Get to grab the index, check for an error. If any, index file
-				// is new so use bucket.Put with the index.Path and index.Content to write data.
-				// Else, append index.Content to the current data and bucket.Put to index.Path. Voila!
-			}
+// storeContent writes the body encoded with the provided encoding to the given path, with its Content-Encoding unless
+// it is not encoded, and by parts if it is not encoded and spooled to disk.
+func storeContent(store Storage, path string, body *SpoolBuffer, encoding string, contType string) error {
+	encoded, err := compressContent(body, encoding)
+	if err != nil {
+		return err
+	}
+	if encoded != body {
+		defer encoded.Close()
+		body = encoded
+	}
+	if encoding != "identity" {
+		reader, err := body.Reader()
+		if err != nil {
+			return err
+		}
+		return store.PutEncoded(path, reader, body.Size(), contType, encoding)
+	}
+	if body.Spooled() {
+		reader, err := body.Reader()
+		if err != nil {
+			return err
+		}
+		log.Debug("Uploading %d bytes to %s by parts.", body.Size(), path)
+		return store.PutStream(path, reader, body.Size(), contType)
+	}
+	data, err := body.Bytes()
+	if err != nil {
+		return err
+	}
+	return store.Put(path, data, contType)
+}
+
+// fetchLog returns the output log of a processed fetch, from the path to its canonical index entry and to its content.
+func fetchLog(store Storage, fetch *HTTPFetch, indexPath string, contentPath string) *Fetch {
+	return &Fetch{Novel: fetch.novel, Unchanged: fetch.unchanged, Parser: fetch.urlInfo.Parser.Name, Status: fetch.response.StatusCode,
+		Encoding: fetch.encoding, FinalLink: fetch.response.Request.URL.String(), Attempts: fetch.attempts, ChecksumIndex: S3Location{Bucket: store.Name(), Path: indexPath},
+		S3Content: S3Location{Bucket: store.Name(), Path: contentPath}, S3Metadata: S3Location{Bucket: store.Name(), Path: contentPath + ".meta"}, ParserData: fetch.urlInfo.Parser, Headers: fetch.headers(),
+		FailedAttempts: fetch.failedAttempts, Request: fetch.urlInfo.Request(), urlInfo: fetch.urlInfo}
+}
+
+// storedEncoding returns the encoding of the content stored at the given path, or an empty string if it cannot be read.
+func storedEncoding(store Storage, contentPath string) string {
+	encoding, err := content.Encoding(store, contentPath)
+	if err != nil {
+		log.Warning("Could not read the encoding of %s: %s", contentPath, err)
+	}
+	return encoding
+}
+
+// writeIndexes writes the secondary indexes, after the canonical index.
+func writeIndexes(store Storage, indexes []IndexInterface, fetch *HTTPFetch, rootPath string, contentPath string) {
+	for _, index := range indexes {
+		if selective, ok := index.(SelectiveIndexInterface); ok && !selective.Accepts(fetch) {
+			continue
+		}
+		indexPath := index.Path(fetch, rootPath)
+		// Each entry is its own object, so that concurrent writers never overwrite each other's entries.
+		entryName, err := indexEntryName(fetch)
+		if err == nil {
+			err = store.Put(indexPath+entryName, []byte(index.Content(fetch, contentPath)), "text/plain")
+		}
+		if err != nil {
+			// The content and the canonical index are stored, so the fetch is not processed again.
+			log.Error("Could not update index %s: %s", indexPath, err)
 		}
-		wg.Done()
 	}
 }
 
-// LogFetches processes all the Fetch items are writes the log to S3 for the parsers to start working.
-func LogFetches(logChan <-chan *Fetch, errChan <-chan *FetchError, duration *time.Duration) {
-	report := &Report{Novel: 0, Errors: 0, Total: 0}
+// LogFetches processes all the Fetch items and writes the log to the storage for the parsers to start working, with the result of the run
+// from the fatal error which aborted it, if any. The log is partial when the run is aborted. The URLs which were never attempted because
+// the run was interrupted, and the fetches which could not be stored, are listed. The log is written in the format defined in the environment.
+// It returns the report of the run.
+func LogFetches(store Storage, fetchLogs []*Fetch, fetchErrors []*FetchError, unattempted []*Unattempted, deadLetters []*DeadLetter, duration *time.Duration, fatal error) (*Report, error) {
+	report := &Report{Novel: 0, Unchanged: 0, Errors: 0, Total: 0}
 	fetchDuration := &FetchDuration{Hours: duration.Hours(), Minutes: duration.Minutes(), Seconds: duration.Seconds()}
-	fetches := &Fetches{}
-	for fetch := range logChan {
-		fetches.Fetch = append(fetches.Fetch, fetch)
+	fetches := &Fetches{Fetch: fetchLogs, FetchError: fetchErrors}
+	for _, fetch := range fetchLogs {
 		if fetch.Novel {
 			report.Novel++
+		} else if fetch.Unchanged {
+			report.Unchanged++
 		}
 		report.Total++
 	}
 
-	for err := range errChan {
-		fetches.FetchError = append(fetches.FetchError, err)
-		report.Errors++
-		report.Total++
+	report.Errors = len(fetchErrors)
+	report.Total += len(fetchErrors)
+
+	fetches.Unattempted = unattempted
+	report.Unattempted = len(unattempted)
+
+	fetches.DeadLetters = deadLetters
+	report.DeadLetters = len(deadLetters)
+	report.Total += len(deadLetters)
+
+	result := &Result{Status: "completed"}
+	if _, interrupted := fatal.(*InterruptError); interrupted {
+		result = &Result{Status: "interrupted", Fatal: fatal.Error()}
+	} else if _, cutOff := fatal.(*DeadlineError); cutOff {
+		result = &Result{Status: "cutoff", Fatal: fatal.Error()}
+	} else if fatal != nil {
+		result = &Result{Status: "aborted", Fatal: fatal.Error()}
+	} else if report.Errors > 0 || report.DeadLetters > 0 {
+		result.Status = "partial"
 	}
+	fetches.Meta = &Meta{Result: result, FetchDuration: fetchDuration, Report: report}
 
-	fetches.Meta = &Meta{FetchDuration: fetchDuration, Report: report}
+	content, contType, err := marshalLog(fetches, LogFormat())
+	if err != nil {
+		return report, err
+	}
 
-	content, _ := xml.MarshalIndent(fetches, "", "\t")
+	// Write to the storage.
+	return report, store.Put(logFilePath(), content, contType)
+}
 
-	// Write to S3.
-	logPath := logFilePath()
-	s3content := []byte(xml.Header + string(content))
-	S3BucketFromOS().Put(logPath, s3content, "application/xml", s3.Private)
+// receiveFetch returns the next fetch log of the channel without waiting, or false if there is none.
+func receiveFetch(logChan <-chan *Fetch) (*Fetch, bool) {
+	select {
+	case fetch, open := <-logChan:
+		return fetch, open
+	default:
+		return nil, false
+	}
+}
+
+// receiveFetchError returns the next fetch error of the channel without waiting, or false if there is none.
+func receiveFetchError(errChan <-chan *FetchError) (*FetchError, bool) {
+	select {
+	case err, open := <-errChan:
+		return err, open
+	default:
+		return nil, false
+	}
 }
 
 func logFilePath() string {
+	return fmt.Sprintf("%s/log/%s_%s_%s_%s.%s", storageRoot(), time.Now().Format("2006-01-02"), os.Getenv("FETCH_ID"), os.Getenv("FETCH_OFFSET"), os.Getenv("FETCH_LIMIT"), LogFormat())
+}
+
+// storageRoot returns the root path of everything gofetch stores.
+func storageRoot() string {
 	rootPath := "/gofetch"
 	if testGofetch {
 		rootPath += "/test_data"
 	}
-	return fmt.Sprintf("%s/log/%s_%s_%s_%s.xml", rootPath, time.Now().Format("2006-01-02"), os.Getenv("FETCH_ID"), os.Getenv("FETCH_OFFSET"), os.Getenv("FETCH_LIMIT"))
+	return rootPath
 }
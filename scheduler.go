@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fetchJob stores a URL to fetch with the state of its attempts.
+type fetchJob struct {
+	urlInfo        *URLInfo   // Stores the UrlInfo to fetch.
+	cleanURL       string     // Stores the cleaned link of the UrlInfo.
+	host           string     // Stores the host of the cleaned link, empty if the link cannot be parsed.
+	attempt        int        // Stores the number of the next attempt.
+	failedAttempts []*Attempt // Stores the failed attempts so far.
+	notBefore      time.Time  // Stores the earliest time of the next attempt, for retries.
+	deadline       time.Time  // Stores the deadline of the fetch, including its retries, zero if it has none.
+}
+
+// newFetchJob returns the fetchJob of the first attempt of a URL.
+func newFetchJob(urlInfo *URLInfo) *fetchJob {
+	cleanURL := strings.Replace(strings.TrimSpace(urlInfo.Link), " ", "+", -1)
+	host := ""
+	if parsedURL, err := url.Parse(cleanURL); err == nil { // Note that the error is caught on the GET.
+		host = parsedURL.Host
+	}
+	return &fetchJob{urlInfo: urlInfo, cleanURL: cleanURL, host: host, attempt: 1}
+}
+
+// attemptContext returns the context of the next attempt of the job, derived from the context of the run, which is
+// cancelled at the deadline of the fetch, if any.
+func (job *fetchJob) attemptContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if job.deadline.IsZero() {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, job.deadline)
+}
+
+// pastDeadline returns whether the provided time is past the deadline of the fetch, if any.
+func (job *fetchJob) pastDeadline(t time.Time) bool {
+	return !job.deadline.IsZero() && !t.Before(job.deadline)
+}
+
+// HostScheduler hands the fetch jobs to the fetchers such that the requests to a host are separated by the
+// throttle delay and that there are no more concurrent requests than allowed to that host, across all the fetchers.
+// The hosts without a throttle get their own copy of the default throttler.
+// A fetcher is only kept waiting when no job at all is ready, so a throttled host does not hold up the other hosts.
+type HostScheduler struct {
+	sync.Mutex                                // Protects the jobs and the throttlers, which are only modified by the scheduler.
+	cond            *sync.Cond                // Wakes up the fetchers waiting for a job.
+	pending         []*fetchJob               // Stores the jobs to be fetched, in order of submission.
+	throttleMap     map[string]*HTTPThrottler // Stores the throttling information per host.
+	defaultThrottle *HTTPThrottler            // Stores the throttling information of the hosts without a throttle.
+	wakeTimer       *time.Timer               // Wakes up the fetchers when the next throttled job is ready.
+	wakeAt          time.Time                 // Stores when the wake timer fires.
+	closed          bool                      // Stores whether the scheduler is closed.
+	stopped         bool                      // Stores whether the scheduler is stopped, in which case it does not accept jobs.
+}
+
+// NewHostScheduler returns a new HostScheduler with the throttling information per host, and of the other hosts.
+// The hosts without a throttle are not throttled if the default throttler is nil.
+func NewHostScheduler(throttleMap map[string]*HTTPThrottler, defaultThrottle *HTTPThrottler) *HostScheduler {
+	sched := &HostScheduler{throttleMap: throttleMap, defaultThrottle: defaultThrottle}
+	sched.cond = sync.NewCond(sched)
+	return sched
+}
+
+// Add adds a job to be fetched. Returns false if the scheduler is stopped, in which case the job is not fetched.
+func (sched *HostScheduler) Add(job *fetchJob) bool {
+	sched.Lock()
+	defer sched.Unlock()
+	if sched.stopped {
+		return false
+	}
+	sched.pending = append(sched.pending, job)
+	sched.cond.Broadcast()
+	return true
+}
+
+// Next waits for the next job which is ready to be fetched and reserves a request to its host.
+// The fetcher must call Done after the request. Returns false once the scheduler is closed.
+func (sched *HostScheduler) Next() (*fetchJob, bool) {
+	sched.Lock()
+	defer sched.Unlock()
+	for {
+		if sched.closed {
+			return nil, false
+		}
+		now := time.Now()
+		var wake time.Time
+		for i, job := range sched.pending {
+			readyAt, ready := sched.readyAt(job, now)
+			if ready {
+				sched.pending = append(sched.pending[:i], sched.pending[i+1:]...)
+				if throttle := sched.throttler(job.host); throttle != nil {
+					throttle.inFlight++
+					throttle.latestFetch = now
+				}
+				return job, true
+			}
+			if !readyAt.IsZero() && (wake.IsZero() || readyAt.Before(wake)) {
+				wake = readyAt
+			}
+		}
+		if !wake.IsZero() {
+			sched.wakeUpAt(wake)
+		}
+		sched.cond.Wait()
+	}
+}
+
+// Done releases the request to the host of the job reserved by Next.
+func (sched *HostScheduler) Done(job *fetchJob) {
+	sched.Lock()
+	defer sched.Unlock()
+	// The throttle may have been created by a crawl delay while the request was in flight.
+	if throttle := sched.throttler(job.host); throttle != nil && throttle.inFlight > 0 {
+		throttle.inFlight--
+	}
+	sched.cond.Broadcast()
+}
+
+// Close stops handing jobs to the fetchers.
+func (sched *HostScheduler) Close() {
+	sched.Lock()
+	defer sched.Unlock()
+	sched.closed = true
+	if sched.wakeTimer != nil {
+		sched.wakeTimer.Stop()
+	}
+	sched.cond.Broadcast()
+}
+
+// Stop closes the scheduler, e.g. on shutdown, and returns the pending jobs, which are not fetched. The jobs added afterwards,
+// e.g. retries, are not accepted either.
+func (sched *HostScheduler) Stop() []*fetchJob {
+	sched.Lock()
+	pending := sched.pending
+	sched.pending = nil
+	sched.stopped = true
+	sched.Unlock()
+	sched.Close()
+	return pending
+}
+
+// readyAt returns whether the job is ready to be fetched now or else when it will be, which is zero if
+// the job waits for a request to its host to be done. The scheduler must be locked.
+func (sched *HostScheduler) readyAt(job *fetchJob, now time.Time) (time.Time, bool) {
+	if now.Before(job.notBefore) {
+		return job.notBefore, false
+	}
+	throttle := sched.throttler(job.host)
+	if throttle == nil {
+		return now, true
+	}
+	if throttle.concurrency > 0 && throttle.inFlight >= throttle.concurrency {
+		return time.Time{}, false
+	}
+	if next := throttle.latestFetch.Add(throttle.delay); now.Before(next) {
+		return next, false
+	}
+	return now, true
+}
+
+// throttler returns the HTTPThrottler of the host, copied from the default throttler if the host has no throttle.
+// Returns nil if the host is not throttled. The scheduler must be locked.
+func (sched *HostScheduler) throttler(host string) *HTTPThrottler {
+	if throttle, exists := sched.throttleMap[host]; exists || host == "" || sched.defaultThrottle == nil {
+		return throttle
+	}
+	throttle := &HTTPThrottler{delay: sched.defaultThrottle.delay, concurrency: sched.defaultThrottle.concurrency, latestFetch: sched.defaultThrottle.latestFetch}
+	sched.throttleMap[host] = throttle
+	return throttle
+}
+
+// SetCrawlDelay raises the delay between the requests to the host to the provided crawl delay, if it is longer.
+func (sched *HostScheduler) SetCrawlDelay(host string, delay time.Duration) {
+	sched.Lock()
+	defer sched.Unlock()
+	throttle := sched.throttler(host)
+	if throttle == nil {
+		throttle = &HTTPThrottler{latestFetch: time.Now()}
+		sched.throttleMap[host] = throttle
+	}
+	if delay > throttle.delay {
+		log.Notice("Host %s: delay of %s as per the crawl delay of its robots.txt.", host, delay)
+		throttle.delay = delay
+	}
+}
+
+// LogPolicies logs the effective throttling policy of each host of the pending jobs, and whether it is the default one.
+func (sched *HostScheduler) LogPolicies() {
+	sched.Lock()
+	defer sched.Unlock()
+	var hosts []string
+	seen := make(map[string]bool)
+	for _, job := range sched.pending {
+		if job.host != "" && !seen[job.host] {
+			seen[job.host] = true
+			hosts = append(hosts, job.host)
+		}
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		_, configured := sched.throttleMap[host]
+		throttle := sched.throttler(host)
+		switch {
+		case throttle == nil:
+			log.Notice("Host %s is not throttled.", host)
+		case configured:
+			log.Notice("Host %s: %s, as configured.", host, throttle.policy())
+		default:
+			log.Notice("Host %s: %s, by default.", host, throttle.policy())
+		}
+	}
+}
+
+// policy returns the description of the throttling policy of the throttler, for the logs.
+func (throttle *HTTPThrottler) policy() string {
+	if throttle.concurrency <= 0 {
+		return fmt.Sprintf("delay of %s and unlimited concurrent requests", throttle.delay)
+	}
+	return fmt.Sprintf("delay of %s and at most %d concurrent requests", throttle.delay, throttle.concurrency)
+}
+
+// wakeUpAt makes sure the fetchers are woken up at the provided time. The scheduler must be locked.
+func (sched *HostScheduler) wakeUpAt(wake time.Time) {
+	if sched.wakeTimer != nil && !sched.wakeAt.After(wake) && sched.wakeAt.After(time.Now()) {
+		return // The fetchers will be woken up earlier.
+	}
+	if sched.wakeTimer != nil {
+		sched.wakeTimer.Stop()
+	}
+	sched.wakeAt = wake
+	sched.wakeTimer = time.AfterFunc(wake.Sub(time.Now()), func() {
+		sched.Lock()
+		defer sched.Unlock()
+		sched.cond.Broadcast()
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestHostScheduler tests the throttling of the hosts by the HostScheduler.
+func TestHostScheduler(t *testing.T) {
+	Convey("The host scheduler tests, ", t, func() {
+		throttleMap := map[string]*HTTPThrottler{
+			"throttled.example.com": {delay: 20 * time.Millisecond, concurrency: 1, latestFetch: time.Now().AddDate(0, 0, -1)},
+		}
+		sched := NewHostScheduler(throttleMap, nil)
+		defer sched.Close()
+
+		Convey("The requests to a throttled host are separated by the delay, across all fetchers", func() {
+			for i := 0; i < 4; i++ {
+				sched.Add(newFetchJob(&URLInfo{Link: "http://throttled.example.com/feed"}))
+			}
+			var mu sync.Mutex
+			var starts []time.Time
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					job, _ := sched.Next()
+					mu.Lock()
+					starts = append(starts, time.Now())
+					mu.Unlock()
+					sched.Done(job)
+				}()
+			}
+			wg.Wait()
+			So(len(starts), ShouldEqual, 4)
+			for i := 1; i < len(starts); i++ {
+				So(starts[i].Sub(starts[i-1]), ShouldBeGreaterThanOrEqualTo, 19*time.Millisecond)
+			}
+		})
+
+		Convey("A throttled host does not hold up the other hosts", func() {
+			sched.Add(newFetchJob(&URLInfo{Link: "http://throttled.example.com/first"}))
+			sched.Add(newFetchJob(&URLInfo{Link: "http://throttled.example.com/second"}))
+			sched.Add(newFetchJob(&URLInfo{Link: "http://other.example.com/feed"}))
+
+			first, _ := sched.Next()
+			So(first.urlInfo.Link, ShouldEqual, "http://throttled.example.com/first")
+			// The second job of the throttled host is not ready, so the next job is for the other host.
+			start := time.Now()
+			other, _ := sched.Next()
+			So(other.urlInfo.Link, ShouldEqual, "http://other.example.com/feed")
+			So(time.Now().Sub(start), ShouldBeLessThan, 10*time.Millisecond)
+			sched.Done(other)
+
+			// The concurrency of the throttled host is one, so the second job waits for the first to be done.
+			go func() {
+				time.Sleep(40 * time.Millisecond)
+				sched.Done(first)
+			}()
+			second, _ := sched.Next()
+			So(second.urlInfo.Link, ShouldEqual, "http://throttled.example.com/second")
+			So(time.Now().Sub(start), ShouldBeGreaterThanOrEqualTo, 40*time.Millisecond)
+			sched.Done(second)
+		})
+
+		Convey("A job is not handed before its retry time", func() {
+			job := newFetchJob(&URLInfo{Link: "http://other.example.com/feed"})
+			job.notBefore = time.Now().Add(20 * time.Millisecond)
+			sched.Add(job)
+			next, _ := sched.Next()
+			So(time.Now(), ShouldHappenOnOrAfter, job.notBefore)
+			sched.Done(next)
+		})
+
+		Convey("The hosts without a throttle each get their own copy of the default throttler", func() {
+			sched := NewHostScheduler(map[string]*HTTPThrottler{}, &HTTPThrottler{delay: 20 * time.Millisecond, concurrency: 1})
+			defer sched.Close()
+			sched.Add(newFetchJob(&URLInfo{Link: "http://first.example.com/feed"}))
+			sched.Add(newFetchJob(&URLInfo{Link: "http://first.example.com/other"}))
+			sched.Add(newFetchJob(&URLInfo{Link: "http://second.example.com/feed"}))
+
+			start := time.Now()
+			first, _ := sched.Next()
+			second, _ := sched.Next()
+			So(first.host, ShouldEqual, "first.example.com")
+			So(second.host, ShouldEqual, "second.example.com")
+			So(time.Now().Sub(start), ShouldBeLessThan, 10*time.Millisecond)
+			So(sched.throttleMap["first.example.com"], ShouldNotPointTo, sched.throttleMap["second.example.com"])
+			sched.Done(first)
+			sched.Done(second)
+
+			third, _ := sched.Next()
+			So(third.urlInfo.Link, ShouldEqual, "http://first.example.com/other")
+			So(time.Now().Sub(start), ShouldBeGreaterThanOrEqualTo, 19*time.Millisecond)
+			sched.Done(third)
+		})
+
+		Convey("The throttling policies are described for the logs, with an unlimited concurrency if it is not positive", func() {
+			So((&HTTPThrottler{delay: time.Second, concurrency: 2}).policy(), ShouldEqual, "delay of 1s and at most 2 concurrent requests")
+			So((&HTTPThrottler{delay: time.Second}).policy(), ShouldEqual, "delay of 1s and unlimited concurrent requests")
+		})
+
+		Convey("Closing the scheduler releases the waiting fetchers", func() {
+			go sched.Close()
+			_, more := sched.Next()
+			So(more, ShouldBeFalse)
+		})
+
+		Convey("Stopping the scheduler returns the pending jobs and refuses the new ones", func() {
+			So(sched.Add(newFetchJob(&URLInfo{Link: "http://throttled.example.com/first"})), ShouldBeTrue)
+			So(sched.Add(newFetchJob(&URLInfo{Link: "http://throttled.example.com/second"})), ShouldBeTrue)
+			pending := sched.Stop()
+			So(len(pending), ShouldEqual, 2)
+			So(pending[0].urlInfo.Link, ShouldEqual, "http://throttled.example.com/first")
+			So(sched.Add(newFetchJob(&URLInfo{Link: "http://throttled.example.com/third"})), ShouldBeFalse)
+			_, more := sched.Next()
+			So(more, ShouldBeFalse)
+		})
+	})
+}
@@ -11,14 +11,34 @@ import (
 	"github.com/op/go-logging"
 )
 
-// CheckEnvVars checks that all the environment variables required are set, without checking their value. It will panic if one is missing.
-func CheckEnvVars() {
-	envvars := []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_STORAGE_BUCKET_NAME", "AWS_CONFIG_FILE", "FETCH_ID", "FETCH_OFFSET", "FETCH_LIMIT"}
+// CheckEnvVars checks that all the environment variables required are set, without checking their value, and returns an error if one is missing.
+// Note that the storage variables required depend on the storage backend.
+func CheckEnvVars() error {
+	envvars := []string{"AWS_CONFIG_FILE", "FETCH_ID", "FETCH_OFFSET", "FETCH_LIMIT"}
+	switch StorageBackend() {
+	case "s3":
+		envvars = append(envvars, "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_STORAGE_BUCKET_NAME")
+	case "file":
+		envvars = append(envvars, "STORAGE_PATH")
+	}
 	for _, envvar := range envvars {
 		if os.Getenv(envvar) == "" {
-			panic(fmt.Errorf("environment variable `%s` is missing or empty,", envvar))
+			return fmt.Errorf("environment variable `%s` is missing or empty", envvar)
 		}
 	}
+	if format := LogFormat(); !validLogFormat(format) {
+		return fmt.Errorf("unknown log format `%s`", format)
+	}
+	return nil
+}
+
+// StorageBackend returns the name of the storage backend to use, as defined in the environment. Defaults to "s3".
+func StorageBackend() string {
+	backend := os.Getenv("STORAGE_BACKEND")
+	if backend == "" {
+		return "s3"
+	}
+	return backend
 }
 
 // ConfigureRuntime configures the server runtime, including the number of CPUs to use.
@@ -51,9 +71,10 @@ func ConfigureLogger() {
 }
 
 // ConcurrentFetches returns the number of fetching go routines to start.
-func ConcurrentFetches(throttled int) int {
-	concurrency := intFromEnvVar("CONCURRENT_FETCHES", 25) + throttled
-	log.Notice("Running with %d fetching go routines (including %d for throttled hosts).\n", concurrency, throttled)
+// Note that throttled hosts do not need additional go routines since the HostScheduler does not block fetchers on them.
+func ConcurrentFetches() int {
+	concurrency := intFromEnvVar("CONCURRENT_FETCHES", 25)
+	log.Notice("Running with %d fetching go routines.\n", concurrency)
 	return concurrency
 }
 
@@ -64,38 +85,104 @@ func ConcurrentS3Writes() int {
 	return concurrency
 }
 
-// FetchOffset returns the fetch offset as defined in the environment. May panic.
-func FetchOffset() int {
+// ShutdownGrace returns the grace period given to the fetches in flight when the run is interrupted, as defined in the environment.
+func ShutdownGrace() time.Duration {
+	return time.Duration(intFromEnvVar("SHUTDOWN_GRACE", 30)) * time.Second
+}
+
+// LogFormat returns the format of the log of the run as defined in the environment: "xml", "json" or "jsonl". Defaults to "xml".
+func LogFormat() string {
+	if format := os.Getenv("LOG_FORMAT"); format != "" {
+		return format
+	}
+	return logFormats[0]
+}
+
+// RunDeadline returns the maximum duration of the run as defined in the environment, zero if the run has no deadline.
+func RunDeadline() time.Duration {
+	return time.Duration(intFromEnvVar("RUN_DEADLINE", 0)) * time.Second
+}
+
+// FetchDeadline returns the maximum duration of the fetch of a URL, including its retries, as defined in the environment,
+// zero if the fetches have no deadline.
+func FetchDeadline() time.Duration {
+	return time.Duration(intFromEnvVar("FETCH_DEADLINE", 0)) * time.Second
+}
+
+// StorageRetryPolicy returns the retry policy of the storage of the fetches, as defined in the environment.
+// Its backoff is in milliseconds, and is doubled at each retry up to 30 seconds.
+func StorageRetryPolicy() *RetryPolicy {
+	attempts := intFromEnvVar("STORAGE_RETRY_ATTEMPTS", 5)
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := time.Duration(intFromEnvVar("STORAGE_RETRY_BACKOFF", 500)) * time.Millisecond
+	log.Notice("Storing each fetch in at most %d attempts, with a backoff of %s.\n", attempts, backoff)
+	return &RetryPolicy{Attempts: attempts, backoff: backoff, maxBackoff: 30 * time.Second}
+}
+
+// StorageRetryQueue returns the maximum number of fetches waiting for a storage retry per S3 writer, as defined in the environment.
+func StorageRetryQueue() int {
+	size := intFromEnvVar("STORAGE_RETRY_QUEUE", 10)
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+// SpoolerFromOS returns the Spooler of the response bodies as defined in the environment.
+func SpoolerFromOS() *Spooler {
+	threshold := intFromEnvVar("SPOOL_THRESHOLD", 8<<20)
+	dir := os.Getenv("SPOOL_PATH")
+	log.Notice("Spooling the response bodies larger than %d bytes to disk.\n", threshold)
+	return &Spooler{threshold: int64(threshold), dir: dir}
+}
+
+// FetchOffset returns the fetch offset as defined in the environment, or an error if it is invalid.
+func FetchOffset() (int, error) {
 	offset := intFromEnvVar("FETCH_OFFSET", -1)
 	if offset < 0 {
-		panic(errors.New("FETCH_OFFSET could not be parsed or is a negative number"))
+		return 0, errors.New("FETCH_OFFSET could not be parsed or is a negative number")
 	}
-	return offset
+	return offset, nil
 }
 
-// FetchLimit returns the fetch limit as defined in the environment. May panic.
-func FetchLimit() int {
+// FetchLimit returns the fetch limit as defined in the environment, or an error if it is invalid.
+func FetchLimit() (int, error) {
 	limit := intFromEnvVar("FETCH_LIMIT", -1)
 	if limit < 0 {
-		panic(errors.New("FETCH_LIMIT could not be parsed or is a negative number"))
+		return 0, errors.New("FETCH_LIMIT could not be parsed or is a negative number")
 	}
-	return limit
+	return limit, nil
 }
 
+// defaultThrottle is the politeness policy of the hosts without a throttle when the configuration file does not define one.
+var defaultThrottle = Throttler{Delay: 0, Unit: "s", Concurrency: 4}
+
 // ThrottleMap returns a map of string to HTTPThrottler allows for O(1) host lookup.
 func ThrottleMap(throttlers []*Throttler) map[string]*HTTPThrottler {
 	throttledMap := make(map[string]*HTTPThrottler)
 	for _, throttle := range throttlers {
-		delay, err := throttle.GetDuration()
-		if err != nil {
-			continue // Error is logged in Duration function.
+		if httpThrottler := throttle.HTTPThrottler(1); httpThrottler != nil {
+			throttledMap[throttle.Host] = httpThrottler
 		}
-		// Initialize the latest fetch to yesterday.
-		throttledMap[throttle.Host] = &HTTPThrottler{delay: delay, latestFetch: time.Now().AddDate(0, 0, -1)}
 	}
 	return throttledMap
 }
 
+// DefaultThrottler returns the HTTPThrottler applied to each host without a throttle, from the configuration file or the built-in default.
+// An error is returned if the configured default throttle is invalid.
+func DefaultThrottler(throttle *Throttler) (*HTTPThrottler, error) {
+	if throttle == nil {
+		throttle = &defaultThrottle
+	}
+	httpThrottler := throttle.HTTPThrottler(defaultThrottle.Concurrency)
+	if httpThrottler == nil {
+		return nil, fmt.Errorf("invalid default throttle")
+	}
+	return httpThrottler, nil
+}
+
 // intFromEnvVar return the requested environment variable as an integer, or the default value.
 func intFromEnvVar(envvar string, deflt int) int {
 	// Note that we're using os instead of syscall because we'll be parsing the int anyway, so there is no need to check if the envvar was found.
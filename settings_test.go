@@ -15,7 +15,7 @@ func TestSettings(t *testing.T) {
 			chkFunc  interface{}
 			expPanic bool
 		}{
-			{"AWS_ACCESS_KEY_ID", CheckEnvVars, true},
+			{"AWS_ACCESS_KEY_ID", func() { So(CheckEnvVars(), ShouldNotBeNil) }, false},
 			{"LOG_LEVEL", ConfigureLogger, false},
 		}
 		for i := range chks {
@@ -32,6 +32,22 @@ func TestSettings(t *testing.T) {
 			})
 		}
 
+		Convey("Unsetting AWS_ACCESS_KEY_ID with the memory storage backend", func() {
+			curVal := os.Getenv("AWS_ACCESS_KEY_ID")
+			os.Unsetenv("AWS_ACCESS_KEY_ID")
+			os.Setenv("STORAGE_BACKEND", "memory")
+			So(CheckEnvVars(), ShouldBeNil)
+			os.Unsetenv("STORAGE_BACKEND")
+			os.Setenv("AWS_ACCESS_KEY_ID", curVal)
+		})
+
+		Convey("Setting STORAGE_BACKEND to an unknown backend", func() {
+			os.Setenv("STORAGE_BACKEND", "carrots")
+			_, err := StorageFromOS()
+			So(err, ShouldNotBeNil)
+			os.Unsetenv("STORAGE_BACKEND")
+		})
+
 		envvar := "LOG_LEVEL"
 		Convey(fmt.Sprintf("Setting %s to an invalid level", envvar), func() {
 			curVal := os.Getenv(envvar)
@@ -45,7 +61,8 @@ func TestSettings(t *testing.T) {
 			Convey(fmt.Sprintf("Setting %s to -2", envvar), func() {
 				curVal := os.Getenv(envvar)
 				os.Setenv(envvar, "-2")
-				So(func() { fun.(func() int)() }, ShouldPanic)
+				_, err := fun.(func() (int, error))()
+				So(err, ShouldNotBeNil)
 				os.Setenv(envvar, curVal)
 			})
 		}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shutdownSignals are the signals which stop a run gracefully.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// InterruptError is the fatal error of a run stopped by a signal.
+type InterruptError struct {
+	Signal  os.Signal     // Stores the signal which stopped the run.
+	Grace   time.Duration // Stores the grace period given to the fetches in flight.
+	Drained bool          // Stores whether the fetches in flight were all processed within the grace period.
+	Forced  bool          // Stores whether another signal ended the grace period.
+}
+
+// Error returns the signal which stopped the run, and whether the fetches in flight were processed.
+func (err *InterruptError) Error() string {
+	switch {
+	case err.Drained:
+		return fmt.Sprintf("interrupted by %s", err.Signal)
+	case err.Forced:
+		return fmt.Sprintf("interrupted by %s, with fetches still in flight when forced by another signal", err.Signal)
+	}
+	return fmt.Sprintf("interrupted by %s, with fetches still in flight after %s", err.Signal, err.Grace)
+}
+
+// DeadlineError is the fatal error of a run cut off by its deadline.
+type DeadlineError struct {
+	Deadline time.Duration // Stores the deadline of the run.
+	Grace    time.Duration // Stores the grace period given to the writes in flight.
+	Drained  bool          // Stores whether the fetches in flight were all processed within the grace period.
+	Forced   bool          // Stores whether a signal ended the grace period.
+}
+
+// Error returns the deadline which cut off the run, and whether the fetches in flight were processed.
+func (err *DeadlineError) Error() string {
+	switch {
+	case err.Drained:
+		return fmt.Sprintf("cut off by the run deadline of %s", err.Deadline)
+	case err.Forced:
+		return fmt.Sprintf("cut off by the run deadline of %s, with fetches still in flight when forced by a signal", err.Deadline)
+	}
+	return fmt.Sprintf("cut off by the run deadline of %s, with fetches still in flight after %s", err.Deadline, err.Grace)
+}
+
+// interrupt stops the run on a signal: the scheduler stops handing out URLs, and the fetches in flight and their
+// writes are given the grace period to complete. The URLs never attempted are recorded for the log of the run.
+// Another signal ends the grace period at once. It returns the fatal error of the run.
+func (run *fetchRun) interrupt(sig os.Signal, signals <-chan os.Signal, scheduler *HostScheduler, wg *sync.WaitGroup, done <-chan struct{}) *InterruptError {
+	grace := ShutdownGrace()
+	log.Warning("Received %s: stopping gofetch, with a grace period of %s.", sig, grace)
+	drained, forced := run.stop(scheduler, "interrupted", wg, done, grace, signals)
+	return &InterruptError{Signal: sig, Grace: grace, Drained: drained, Forced: forced}
+}
+
+// cutOff stops the run at its deadline: the scheduler stops handing out URLs, the fetches in flight are cancelled by the
+// context of the run, and the writes in flight are given the grace period to complete. The URLs never attempted are
+// recorded for the log of the run. A signal ends the grace period at once. It returns the fatal error of the run.
+func (run *fetchRun) cutOff(deadline time.Duration, signals <-chan os.Signal, scheduler *HostScheduler, wg *sync.WaitGroup, done <-chan struct{}) *DeadlineError {
+	grace := ShutdownGrace()
+	log.Warning("Reached the run deadline of %s: stopping gofetch, with a grace period of %s.", deadline, grace)
+	drained, forced := run.stop(scheduler, "cutoff", wg, done, grace, signals)
+	return &DeadlineError{Deadline: deadline, Grace: grace, Drained: drained, Forced: forced}
+}
+
+// stop stops the scheduler, records its pending jobs either as unattempted or as errors with the provided reason if
+// they wait for a retry, and waits for the fetches in flight for the grace period, unless a signal forces the run to stop.
+// Returns whether they were all processed, and whether a signal forced the run to stop.
+func (run *fetchRun) stop(scheduler *HostScheduler, reason string, wg *sync.WaitGroup, done <-chan struct{}, grace time.Duration, signals <-chan os.Signal) (bool, bool) {
+	for _, job := range scheduler.Stop() {
+		if job.attempt == 1 {
+			run.unattempted = append(run.unattempted, &Unattempted{Original: job.urlInfo.Link, Cleaned: job.cleanURL})
+		} else {
+			run.errChan <- job.stoppedError(reason, fmt.Sprintf("before attempt %d", job.attempt), job.attempt-1)
+		}
+		wg.Done()
+	}
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-done:
+		log.Notice("All the fetches in flight were processed.")
+		return true, false
+	case <-timer.C:
+		// The go routines are left running, and the URLs they process are missing from the log.
+		log.Error("Fetches are still in flight after the grace period of %s.", grace)
+		return false, false
+	case sig := <-signals:
+		// The fetches in flight are cancelled with the context of the run once it returns.
+		log.Error("Received %s during the grace period: stopping gofetch with fetches still in flight.", sig)
+		return false, true
+	}
+}
+
+// stopReason returns the reason of the errors of the URLs stopped with the run: "cutoff" if the context of the run
+// reached its deadline, or "interrupted" otherwise.
+func stopReason(ctx context.Context) string {
+	if ctx.Err() == context.DeadlineExceeded {
+		return "cutoff"
+	}
+	return "interrupted"
+}
+
+// stoppedMessage returns the message of the error of a URL stopped with the run, with the provided reason and the moment
+// it was stopped (e.g. "before attempt 2").
+func stoppedMessage(reason string, moment string) string {
+	if reason == "cutoff" {
+		return fmt.Sprintf("cut off by the run deadline %s", moment)
+	}
+	return fmt.Sprintf("interrupted %s", moment)
+}
+
+// stoppedError returns the error of the job stopped with the run, with the provided reason, the moment it was stopped
+// (e.g. "before attempt 2") and the number of attempts made.
+func (job *fetchJob) stoppedError(reason string, moment string, attempts int) *FetchError {
+	return &FetchError{urlInfo: job.urlInfo, Cleaned: job.cleanURL, Original: job.urlInfo.Link, Reason: reason, Message: stoppedMessage(reason, moment),
+		Attempts: attempts, FailedAttempts: job.failedAttempts}
+}
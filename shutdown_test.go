@@ -0,0 +1,50 @@
+package main
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestShutdown tests the grace period given to the fetches in flight when a run is interrupted.
+func TestShutdown(t *testing.T) {
+	Convey("The shutdown tests, ", t, func() {
+		os.Setenv("SHUTDOWN_GRACE", "30")
+		defer os.Unsetenv("SHUTDOWN_GRACE")
+		run := &fetchRun{errChan: make(chan *FetchError, 1)}
+		sched := NewHostScheduler(map[string]*HTTPThrottler{}, nil)
+		defer sched.Close()
+		// One URL is waiting to be fetched, and another one is in flight.
+		var wg sync.WaitGroup
+		wg.Add(2)
+		sched.Add(newFetchJob(&URLInfo{Link: "http://example.com/pending"}))
+		done := make(chan struct{})
+		signals := make(chan os.Signal, 1)
+
+		Convey("The interrupted run waits for the fetches in flight", func() {
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				wg.Done()
+				close(done)
+			}()
+			err := run.interrupt(os.Interrupt, signals, sched, &wg, done)
+			So(err.Drained, ShouldBeTrue)
+			So(err.Forced, ShouldBeFalse)
+			So(len(run.unattempted), ShouldEqual, 1)
+		})
+
+		Convey("Another signal ends the grace period at once, with the fetches still in flight", func() {
+			signals <- syscall.SIGTERM
+			start := time.Now()
+			err := run.interrupt(os.Interrupt, signals, sched, &wg, done)
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+			So(err.Drained, ShouldBeFalse)
+			So(err.Forced, ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, "forced by another signal")
+			So(len(run.unattempted), ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// ReaderAtSeeker is a reader of a body which can be read by parts, e.g. for a multipart upload.
+type ReaderAtSeeker interface {
+	io.ReaderAt
+	io.ReadSeeker
+}
+
+// Spooler creates the buffers of the response bodies, which are spooled to disk beyond the threshold.
+type Spooler struct {
+	threshold int64  // Stores the size in bytes beyond which a body is spooled to disk.
+	dir       string // Stores the directory of the spool files, the default temporary directory if empty.
+}
+
+// SpoolBuffer stores a response body in memory up to the spool threshold, and in a temporary file beyond.
+type SpoolBuffer struct {
+	spooler *Spooler     // Stores the spooler of the buffer.
+	memory  bytes.Buffer // Stores the body while it is not spooled.
+	file    *os.File     // Stores the spool file, nil if the body is in memory.
+	size    int64        // Stores the size of the body.
+}
+
+// NewBuffer returns a new and empty SpoolBuffer.
+func (spooler *Spooler) NewBuffer() *SpoolBuffer {
+	return &SpoolBuffer{spooler: spooler}
+}
+
+// Write appends the data to the body, moving the body to a spool file when it gets larger than the threshold.
+func (spool *SpoolBuffer) Write(data []byte) (int, error) {
+	if spool.file == nil && spool.size+int64(len(data)) > spool.spooler.threshold {
+		file, err := ioutil.TempFile(spool.spooler.dir, "gofetch-spool-")
+		if err != nil {
+			return 0, err
+		}
+		spool.file = file
+		if _, err := spool.memory.WriteTo(file); err != nil {
+			return 0, err
+		}
+	}
+	var written int
+	var err error
+	if spool.file != nil {
+		written, err = spool.file.Write(data)
+	} else {
+		written, err = spool.memory.Write(data)
+	}
+	spool.size += int64(written)
+	return written, err
+}
+
+// Spooled returns whether the body is spooled to disk.
+func (spool *SpoolBuffer) Spooled() bool {
+	return spool.file != nil
+}
+
+// Size returns the size of the body.
+func (spool *SpoolBuffer) Size() int64 {
+	return spool.size
+}
+
+// Bytes returns the body, read from the spool file if needed.
+func (spool *SpoolBuffer) Bytes() ([]byte, error) {
+	if spool.file == nil {
+		return spool.memory.Bytes(), nil
+	}
+	data := make([]byte, spool.size)
+	_, err := spool.file.ReadAt(data, 0)
+	return data, err
+}
+
+// Reader returns a reader of the whole body, from its beginning.
+func (spool *SpoolBuffer) Reader() (ReaderAtSeeker, error) {
+	if spool.file == nil {
+		return bytes.NewReader(spool.memory.Bytes()), nil
+	}
+	if _, err := spool.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return spool.file, nil
+}
+
+// Close releases the body, removing the spool file if any.
+func (spool *SpoolBuffer) Close() error {
+	spool.memory.Reset()
+	if spool.file == nil {
+		return nil
+	}
+	spool.file.Close()
+	err := os.Remove(spool.file.Name())
+	spool.file = nil
+	return err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestSpoolBuffer tests the spooling of the response bodies to disk, and their storage by parts.
+func TestSpoolBuffer(t *testing.T) {
+	Convey("The spool buffer tests, ", t, func() {
+		dir, err := ioutil.TempDir("", "gofetch-spool-test-")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		spooler := &Spooler{threshold: 16, dir: dir}
+
+		Convey("A body up to the threshold stays in memory", func() {
+			body := spooler.NewBuffer()
+			body.Write([]byte(strings.Repeat("m", 16)))
+			So(body.Spooled(), ShouldBeFalse)
+			data, err := body.Bytes()
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, strings.Repeat("m", 16))
+			So(body.Close(), ShouldBeNil)
+		})
+
+		Convey("A body larger than the threshold is spooled to disk and removed once closed", func() {
+			body := spooler.NewBuffer()
+			body.Write([]byte(strings.Repeat("s", 10)))
+			body.Write([]byte(strings.Repeat("S", 10)))
+			So(body.Spooled(), ShouldBeTrue)
+			So(body.Size(), ShouldEqual, 20)
+			files, _ := ioutil.ReadDir(dir)
+			So(len(files), ShouldEqual, 1)
+
+			store := NewMemoryStorage()
+			So(storeContent(store, "/spooled", body, "identity", "text/plain"), ShouldBeNil)
+			data, err := store.Get("/spooled")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, strings.Repeat("s", 10)+strings.Repeat("S", 10))
+
+			fileStore := &FileStorage{root: dir}
+			So(storeContent(fileStore, "/stored/spooled", body, "identity", "text/plain"), ShouldBeNil)
+			data, err = fileStore.Get("/stored/spooled")
+			So(err, ShouldBeNil)
+			So(len(data), ShouldEqual, 20)
+
+			So(body.Close(), ShouldBeNil)
+			files, _ = ioutil.ReadDir(dir)
+			So(len(files), ShouldEqual, 1) // Only the stored directory is left.
+			So(files[0].Name(), ShouldEqual, "stored")
+		})
+	})
+}
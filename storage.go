@@ -0,0 +1,417 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mitchellh/goamz/s3"
+)
+
+// Storage details what can be considered a storage backend for the content, the indexes and the logs.
+type Storage interface {
+	Name() string                                                                                    // Returns the name of the storage, written in the output log as the bucket.
+	Get(path string) ([]byte, error)                                                                 // Returns the data stored at the given path.
+	Put(path string, data []byte, contType string) error                                             // Writes the data to the given path, overwriting any previous data.
+	PutStream(path string, data ReaderAtSeeker, size int64, contType string) error                   // Writes the large data to the given path by parts, overwriting any previous data.
+	PutEncoded(path string, data ReaderAtSeeker, size int64, contType string, encoding string) error // Writes the data encoded with the given content encoding to the given path, overwriting any previous data.
+	PutIfAbsent(path string, data []byte, contType string) (bool, error)                             // Atomically writes the data to the given path unless some data is stored there, and returns whether it was written.
+	Exists(path string) (bool, error)                                                                // Returns whether some data is stored at the given path.
+	Delete(path string) error                                                                        // Deletes the data stored at the given path.
+	List(prefix string) ([]string, error)                                                            // Returns the paths starting with the given prefix, in lexical order.
+}
+
+// StorageFromOS returns the storage backend as defined in the environment (cf. README.md), or an error if it cannot be used.
+func StorageFromOS() (Storage, error) {
+	switch backend := StorageBackend(); backend {
+	case "s3":
+		bucket, err := S3BucketFromOS()
+		if err != nil {
+			return nil, err
+		}
+		return &S3Storage{bucket: bucket}, nil
+	case "file":
+		return &FileStorage{root: os.Getenv("STORAGE_PATH")}, nil
+	case "memory":
+		return memoryStorage, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend `%s`", backend)
+	}
+}
+
+// S3Storage stores everything on AWS S3.
+type S3Storage struct {
+	bucket *s3.Bucket // Stores the bucket where all the data is written.
+}
+
+// Name returns the name of the bucket.
+func (store *S3Storage) Name() string {
+	return store.bucket.Name
+}
+
+// Get returns the data stored at the given path in the bucket.
+func (store *S3Storage) Get(path string) ([]byte, error) {
+	return store.bucket.Get(path)
+}
+
+// Put writes the data to the given path in the bucket as a private object.
+func (store *S3Storage) Put(path string, data []byte, contType string) error {
+	return store.bucket.Put(path, data, contType, s3.Private)
+}
+
+// PutStream writes the data to the given path in the bucket as a private object, with a multipart upload.
+// The upload is aborted if a part cannot be uploaded, so that its parts are not kept by S3.
+func (store *S3Storage) PutStream(path string, data ReaderAtSeeker, size int64, contType string) error {
+	multi, err := store.bucket.InitMulti(path, contType, s3.Private)
+	if err != nil {
+		return err
+	}
+	parts, err := multi.PutAll(data, multipartPartSize)
+	if err == nil {
+		err = multi.Complete(parts)
+	}
+	if err != nil {
+		if abortErr := multi.Abort(); abortErr != nil {
+			log.Warning("Could not abort the multipart upload of %s: %s", path, abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// PutEncoded writes the encoded data to the given path in the bucket as a private object, with its Content-Encoding.
+// The data is written with a single upload, as the multipart uploads cannot set the Content-Encoding of the object.
+func (store *S3Storage) PutEncoded(path string, data ReaderAtSeeker, size int64, contType string, encoding string) error {
+	headers := map[string][]string{"Content-Type": {contType}, "Content-Encoding": {encoding}}
+	return store.bucket.PutReaderHeader(path, io.NewSectionReader(data, 0, size), size, headers, s3.Private)
+}
+
+// PutIfAbsent writes the data to the given path in the bucket as a private object, with a conditional write
+// which S3 rejects if the path exists.
+func (store *S3Storage) PutIfAbsent(path string, data []byte, contType string) (bool, error) {
+	headers := map[string][]string{"Content-Type": {contType}, "If-None-Match": {"*"}}
+	err := store.bucket.PutHeader(path, data, headers, s3.Private)
+	if s3Err, ok := err.(*s3.Error); ok && s3Err.StatusCode == 412 {
+		return false, nil // Precondition failed: the path exists.
+	}
+	return err == nil, err
+}
+
+// Exists returns whether the given path exists in the bucket.
+func (store *S3Storage) Exists(path string) (bool, error) {
+	resp, err := store.bucket.Head(path)
+	if err != nil {
+		if isS3NotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// Delete deletes the given path from the bucket.
+func (store *S3Storage) Delete(path string) error {
+	return store.bucket.Del(path)
+}
+
+// multipartPartSize is the size of the parts of the multipart uploads to S3, which is the minimum accepted by S3.
+const multipartPartSize = 5 << 20
+
+// List returns the paths in the bucket starting with the given prefix.
+func (store *S3Storage) List(prefix string) ([]string, error) {
+	// The keys do not start with a slash, unlike the paths.
+	keyPrefix := strings.TrimPrefix(prefix, "/")
+	var paths []string
+	marker := ""
+	for {
+		resp, err := store.bucket.List(keyPrefix, "", marker, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range resp.Contents {
+			paths = append(paths, "/"+key.Key)
+			marker = key.Key
+		}
+		if !resp.IsTruncated {
+			return paths, nil
+		}
+	}
+}
+
+// isS3NotFound returns whether the provided error is an S3 error for a missing key.
+func isS3NotFound(err error) bool {
+	s3Err, ok := err.(*s3.Error)
+	return ok && s3Err.StatusCode == 404
+}
+
+// FileStorage stores everything on the local file system, under a root directory.
+// The paths are the same as on S3, which allows running gofetch without AWS credentials.
+type FileStorage struct {
+	root string // Stores the root directory of all the paths.
+}
+
+// Name returns the root directory.
+func (store *FileStorage) Name() string {
+	return store.root
+}
+
+// Get returns the content of the file at the given path.
+func (store *FileStorage) Get(path string) ([]byte, error) {
+	return ioutil.ReadFile(store.filePath(path))
+}
+
+// Put writes the data to the file at the given path, creating any missing directory. The content type is ignored.
+func (store *FileStorage) Put(path string, data []byte, contType string) error {
+	fpath := store.filePath(path)
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fpath, data, 0644)
+}
+
+// PutStream copies the data to the file at the given path, creating any missing directory. The content type is ignored.
+func (store *FileStorage) PutStream(path string, data ReaderAtSeeker, size int64, contType string) error {
+	fpath := store.filePath(path)
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(fpath)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(file, io.NewSectionReader(data, 0, size)); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// PutEncoded copies the encoded data to the file at the given path, creating any missing directory. The content type and
+// encoding are ignored.
+func (store *FileStorage) PutEncoded(path string, data ReaderAtSeeker, size int64, contType string, encoding string) error {
+	return store.PutStream(path, data, size, contType)
+}
+
+// PutIfAbsent writes the data to the file at the given path unless it exists, creating any missing directory. The content type is ignored.
+func (store *FileStorage) PutIfAbsent(path string, data []byte, contType string) (bool, error) {
+	fpath := store.filePath(path)
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return false, err
+	}
+	file, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return true, err
+	}
+	return true, file.Close()
+}
+
+// Exists returns whether the file at the given path exists.
+func (store *FileStorage) Exists(path string) (bool, error) {
+	info, err := os.Stat(store.filePath(path))
+	if err == nil {
+		return !info.IsDir(), nil // As on S3, a directory is not some data.
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// Delete removes the file at the given path. As on S3, deleting a missing file is not an error.
+func (store *FileStorage) Delete(path string) error {
+	err := os.Remove(store.filePath(path))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns the paths of the files starting with the given prefix.
+func (store *FileStorage) List(prefix string) ([]string, error) {
+	// Only the directory of the prefix is walked, since the files are stored by directory.
+	dir := store.filePath(prefix[:strings.LastIndex(prefix, "/")+1])
+	var paths []string
+	err := filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(store.root, fpath)
+		if err != nil {
+			return err
+		}
+		if path := "/" + filepath.ToSlash(rel); !info.IsDir() && strings.HasPrefix(path, prefix) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	sort.Strings(paths)
+	return paths, err
+}
+
+// filePath returns the path on the file system of the provided storage path.
+func (store *FileStorage) filePath(path string) string {
+	return filepath.Join(store.root, filepath.FromSlash(path))
+}
+
+// memoryStorage is the storage shared by all the users of the memory backend for the lifetime of the process.
+var memoryStorage = NewMemoryStorage()
+
+// MemoryStorage stores everything in memory. It is meant for testing since nothing is persisted.
+type MemoryStorage struct {
+	sync.RWMutex                          // Protects the objects from concurrent writers.
+	objects      map[string]*memoryObject // Stores the objects by path.
+}
+
+// memoryObject stores an object of the MemoryStorage.
+type memoryObject struct {
+	data     []byte // Stores the data of the object.
+	contType string // Stores the content type of the object.
+	encoding string // Stores the content encoding of the object, if any.
+}
+
+// NewMemoryStorage returns a new and empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{objects: make(map[string]*memoryObject)}
+}
+
+// Name returns the name of the memory storage.
+func (store *MemoryStorage) Name() string {
+	return "memory"
+}
+
+// Get returns a copy of the data stored at the given path.
+func (store *MemoryStorage) Get(path string) ([]byte, error) {
+	store.RLock()
+	defer store.RUnlock()
+	obj, exists := store.objects[path]
+	if !exists {
+		return nil, fmt.Errorf("no data stored at `%s`", path)
+	}
+	return append([]byte(nil), obj.data...), nil
+}
+
+// Put stores a copy of the data at the given path.
+func (store *MemoryStorage) Put(path string, data []byte, contType string) error {
+	store.Lock()
+	defer store.Unlock()
+	store.objects[path] = &memoryObject{data: append([]byte(nil), data...), contType: contType}
+	return nil
+}
+
+// PutStream reads and stores the data at the given path.
+func (store *MemoryStorage) PutStream(path string, data ReaderAtSeeker, size int64, contType string) error {
+	copied, err := ioutil.ReadAll(io.NewSectionReader(data, 0, size))
+	if err != nil {
+		return err
+	}
+	store.Lock()
+	defer store.Unlock()
+	store.objects[path] = &memoryObject{data: copied, contType: contType}
+	return nil
+}
+
+// PutEncoded reads and stores the encoded data at the given path, with its encoding.
+func (store *MemoryStorage) PutEncoded(path string, data ReaderAtSeeker, size int64, contType string, encoding string) error {
+	copied, err := ioutil.ReadAll(io.NewSectionReader(data, 0, size))
+	if err != nil {
+		return err
+	}
+	store.Lock()
+	defer store.Unlock()
+	store.objects[path] = &memoryObject{data: copied, contType: contType, encoding: encoding}
+	return nil
+}
+
+// PutIfAbsent stores a copy of the data at the given path unless some data is stored there.
+func (store *MemoryStorage) PutIfAbsent(path string, data []byte, contType string) (bool, error) {
+	store.Lock()
+	defer store.Unlock()
+	if _, exists := store.objects[path]; exists {
+		return false, nil
+	}
+	store.objects[path] = &memoryObject{data: append([]byte(nil), data...), contType: contType}
+	return true, nil
+}
+
+// Exists returns whether some data is stored at the given path.
+func (store *MemoryStorage) Exists(path string) (bool, error) {
+	store.RLock()
+	defer store.RUnlock()
+	_, exists := store.objects[path]
+	return exists, nil
+}
+
+// Delete deletes the data stored at the given path.
+func (store *MemoryStorage) Delete(path string) error {
+	store.Lock()
+	defer store.Unlock()
+	delete(store.objects, path)
+	return nil
+}
+
+// List returns the paths starting with the given prefix.
+func (store *MemoryStorage) List(prefix string) ([]string, error) {
+	store.RLock()
+	defer store.RUnlock()
+	var paths []string
+	for path := range store.objects {
+		if strings.HasPrefix(path, prefix) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Paths returns all the paths stored in memory.
+func (store *MemoryStorage) Paths() []string {
+	store.RLock()
+	defer store.RUnlock()
+	paths := make([]string, 0, len(store.objects))
+	for path := range store.objects {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// ContentType returns the content type of the data stored at the given path, or an empty string if there is none.
+func (store *MemoryStorage) ContentType(path string) string {
+	store.RLock()
+	defer store.RUnlock()
+	if obj, exists := store.objects[path]; exists {
+		return obj.contType
+	}
+	return ""
+}
+
+// ContentEncoding returns the content encoding of the data stored at the given path, or an empty string if there is none.
+func (store *MemoryStorage) ContentEncoding(path string) string {
+	store.RLock()
+	defer store.RUnlock()
+	if obj, exists := store.objects[path]; exists {
+		return obj.encoding
+	}
+	return ""
+}
+
+// Reset deletes everything stored in memory.
+func (store *MemoryStorage) Reset() {
+	store.Lock()
+	defer store.Unlock()
+	store.objects = make(map[string]*memoryObject)
+}
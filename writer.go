@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DeadLetters is the list of the fetches which could not be stored after all their storage attempts, shared by the S3 writers.
+type DeadLetters struct {
+	sync.Mutex               // Protects the letters.
+	letters    []*DeadLetter // Stores the dead letters, in order of failure.
+}
+
+// retryQueue is the bounded queue of the fetches of an S3 writer which wait for a storage retry.
+type retryQueue struct {
+	size    int          // Stores the maximum number of fetches in the queue.
+	fetches []*HTTPFetch // Stores the fetches waiting for a retry, in order of failure.
+	closed  bool         // Stores whether the channel of the new fetches is closed.
+}
+
+// Add adds the dead letter of a fetch which could not be stored.
+func (deadLetters *DeadLetters) Add(letter *DeadLetter) {
+	deadLetters.Lock()
+	defer deadLetters.Unlock()
+	deadLetters.letters = append(deadLetters.letters, letter)
+}
+
+// List returns the dead letters added so far.
+func (deadLetters *DeadLetters) List() []*DeadLetter {
+	deadLetters.Lock()
+	defer deadLetters.Unlock()
+	return append([]*DeadLetter(nil), deadLetters.letters...)
+}
+
+// newRetryQueue returns a new and empty retryQueue of the provided size.
+func newRetryQueue(size int) *retryQueue {
+	return &retryQueue{size: size}
+}
+
+// Add adds a fetch to be retried once its retry time is reached. The queue must not be full, which Next ensures.
+func (queue *retryQueue) Add(fetch *HTTPFetch) {
+	queue.fetches = append(queue.fetches, fetch)
+}
+
+// Next waits for the next fetch to store: either a retry whose time is reached, or a new fetch from the channel unless
+// the queue is full, so that a writer never blocks on its own retries. The retries are all due once the context is done,
+// so that they are cut off without waiting. Returns false once the channel is closed and no retry is left.
+func (queue *retryQueue) Next(ctx context.Context, s3chan <-chan *HTTPFetch) (*HTTPFetch, bool) {
+	for {
+		var timer *time.Timer
+		var wake <-chan time.Time
+		var cancelled <-chan struct{}
+		if len(queue.fetches) > 0 {
+			next := 0
+			for i, fetch := range queue.fetches {
+				if fetch.retryAt.Before(queue.fetches[next].retryAt) {
+					next = i
+				}
+			}
+			fetch := queue.fetches[next]
+			wait := time.Until(fetch.retryAt)
+			if wait <= 0 || ctx.Err() != nil {
+				queue.fetches = append(queue.fetches[:next], queue.fetches[next+1:]...)
+				return fetch, true
+			}
+			timer = time.NewTimer(wait)
+			wake, cancelled = timer.C, ctx.Done()
+		} else if queue.closed {
+			return nil, false
+		}
+		var incoming <-chan *HTTPFetch
+		if !queue.closed && len(queue.fetches) < queue.size {
+			incoming = s3chan
+		}
+		var fetch *HTTPFetch
+		open := false
+		select {
+		case fetch, open = <-incoming:
+			queue.closed = !open
+		case <-wake:
+		case <-cancelled:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if fetch != nil {
+			return fetch, true
+		}
+	}
+}
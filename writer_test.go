@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"github.com/Sparrho/gofetch/content"
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingStorage is a storage whose writes to the paths with its prefix fail a number of times.
+type failingStorage struct {
+	Storage
+	sync.Mutex
+	prefix   string // Stores the prefix of the failing paths.
+	failures int    // Stores the number of failures left.
+}
+
+// TestStorageWriter tests the retries and the dead letters of the S3 writers.
+func TestStorageWriter(t *testing.T) {
+	Convey("The storage writer tests, ", t, func() {
+		store := &failingStorage{Storage: NewMemoryStorage(), prefix: storageRoot() + "/sha384_content/"}
+		logChan, errChan := make(chan *Fetch, 10), make(chan *FetchError, 10)
+		writer := &StorageWriter{store: store, leases: NewLocalLeases(), encoding: "identity", retry: &RetryPolicy{Attempts: 3, backoff: time.Millisecond, maxBackoff: time.Millisecond},
+			queueSize: 1, logChan: logChan, errChan: errChan, deadLetters: &DeadLetters{}}
+		// process writes the fetches with two writers, and returns whether they were all marked done.
+		process := func(fetches ...*HTTPFetch) bool {
+			s3chan := make(chan *HTTPFetch)
+			var wg sync.WaitGroup
+			wg.Add(len(fetches))
+			for i := 0; i < 2; i++ {
+				go writer.ProcessResponses(context.Background(), s3chan, &wg)
+			}
+			for _, fetch := range fetches {
+				s3chan <- fetch
+			}
+			done := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+			defer close(s3chan)
+			select {
+			case <-done:
+				return true
+			case <-time.After(5 * time.Second):
+				return false
+			}
+		}
+
+		Convey("A fetch is stored once the storage recovers, after a backoff", func() {
+			store.failures = 2
+			So(process(testHTTPFetch("http://example.com/feed", "rss")), ShouldBeTrue)
+			So(len(logChan), ShouldEqual, 1)
+			fetch := <-logChan
+			So(fetch.Novel, ShouldBeTrue)
+			So(writer.deadLetters.List(), ShouldBeEmpty)
+			decoded, err := content.Read(store, fetch.S3Content.Path)
+			So(err, ShouldBeNil)
+			So(string(decoded), ShouldEqual, "content")
+			// The canonical index entry is written once across the attempts.
+			entries, _ := store.List(storageRoot() + "/index/sha384_checksum/abc/")
+			So(len(entries), ShouldEqual, 1)
+		})
+
+		Convey("The fetches which cannot be stored are dead lettered, without blocking the writers on their full retry queues", func() {
+			store.failures = 1000
+			var fetches []*HTTPFetch
+			for i := 0; i < 5; i++ {
+				fetch := testHTTPFetch(fmt.Sprintf("http://example.com/feed%d", i), "rss")
+				fetch.checksum = fmt.Sprintf("checksum%d", i)
+				fetches = append(fetches, fetch)
+			}
+			So(process(fetches...), ShouldBeTrue)
+			So(len(logChan), ShouldEqual, 0)
+			deadLetters := writer.deadLetters.List()
+			So(len(deadLetters), ShouldEqual, 5)
+			for _, letter := range deadLetters {
+				So(letter.Attempts, ShouldEqual, 3)
+				So(len(letter.FailedAttempts), ShouldEqual, 3)
+				So(letter.Message, ShouldContainSubstring, "unavailable")
+			}
+		})
+
+		Convey("The content whose first fetch was dead lettered is novel for the fetch which stores it", func() {
+			writer.indexes = []IndexInterface{NovelByParserIndex{}}
+			store.failures = 1000
+			So(process(testHTTPFetch("http://example.com/feed", "rss")), ShouldBeTrue)
+			So(len(writer.deadLetters.List()), ShouldEqual, 1)
+			store.failures = 0
+			So(process(testHTTPFetch("http://example.com/feed", "rss")), ShouldBeTrue)
+			So(len(logChan), ShouldEqual, 1)
+			So((<-logChan).Novel, ShouldBeTrue)
+			novelIdx, err := ReadIndex(store, NovelByParserIndex{}.Path(testHTTPFetch("http://example.com/feed", "rss"), storageRoot()))
+			So(err, ShouldBeNil)
+			So(strings.Count(string(novelIdx), "\n"), ShouldEqual, 1)
+		})
+
+		Convey("The dead letters are listed in the log of the run, which is partial", func() {
+			duration := time.Second
+			letter := &DeadLetter{Original: "http://example.com/feed", Cleaned: "http://example.com/feed", Checksum: "abc", Message: "storage unavailable", Attempts: 3}
+			report, err := LogFetches(store, nil, nil, nil, []*DeadLetter{letter}, &duration, nil)
+			So(err, ShouldBeNil)
+			So(report.DeadLetters, ShouldEqual, 1)
+			So(report.Total, ShouldEqual, 1)
+			logBody, _ := store.Get(logFilePath())
+			log := Fetches{}
+			So(xml.Unmarshal(logBody, &log), ShouldBeNil)
+			So(log.Meta.Result.Status, ShouldEqual, "partial")
+			So(log.DeadLetters, ShouldResemble, []*DeadLetter{letter})
+		})
+
+		Convey("The retries are cut off once the context is done", func() {
+			store.failures = 1000
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			writer.retry = &RetryPolicy{Attempts: 3, backoff: time.Hour, maxBackoff: time.Hour}
+			s3chan := make(chan *HTTPFetch, 1)
+			var wg sync.WaitGroup
+			wg.Add(1)
+			s3chan <- testHTTPFetch("http://example.com/feed", "rss")
+			close(s3chan)
+			// The writer returns once the retry it holds is cut off.
+			writer.ProcessResponses(ctx, s3chan, &wg)
+			wg.Wait()
+			So(len(errChan), ShouldEqual, 1)
+			fetchErr := <-errChan
+			So(fetchErr.Reason, ShouldEqual, "cutoff")
+			So(fetchErr.Message, ShouldEqual, "cut off by the run deadline before being stored")
+			So(writer.deadLetters.List(), ShouldBeEmpty)
+		})
+
+		Convey("The fetches are not stored once the run is interrupted", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			s3chan := make(chan *HTTPFetch, 1)
+			var wg sync.WaitGroup
+			wg.Add(1)
+			s3chan <- testHTTPFetch("http://example.com/feed", "rss")
+			close(s3chan)
+			writer.ProcessResponses(ctx, s3chan, &wg)
+			wg.Wait()
+			So(len(errChan), ShouldEqual, 1)
+			fetchErr := <-errChan
+			So(fetchErr.Reason, ShouldEqual, "interrupted")
+			So(fetchErr.Message, ShouldEqual, "interrupted before being stored")
+			paths, _ := store.List(storageRoot())
+			So(paths, ShouldBeEmpty)
+		})
+	})
+}
+
+// fail returns whether the write to the path fails.
+func (store *failingStorage) fail(path string) bool {
+	store.Lock()
+	defer store.Unlock()
+	if !strings.HasPrefix(path, store.prefix) || store.failures == 0 {
+		return false
+	}
+	store.failures--
+	return true
+}
+
+// Put on failingStorage fails as configured.
+func (store *failingStorage) Put(path string, data []byte, contType string) error {
+	if store.fail(path) {
+		return fmt.Errorf("storage unavailable")
+	}
+	return store.Storage.Put(path, data, contType)
+}
+
+// PutStream on failingStorage fails as configured.
+func (store *failingStorage) PutStream(path string, reader ReaderAtSeeker, size int64, contType string) error {
+	if store.fail(path) {
+		return fmt.Errorf("storage unavailable")
+	}
+	return store.Storage.PutStream(path, reader, size, contType)
+}
+
+// PutEncoded on failingStorage fails as configured.
+func (store *failingStorage) PutEncoded(path string, reader ReaderAtSeeker, size int64, contType string, encoding string) error {
+	if store.fail(path) {
+		return fmt.Errorf("storage unavailable")
+	}
+	return store.Storage.PutEncoded(path, reader, size, contType, encoding)
+}